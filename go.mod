@@ -4,6 +4,6 @@ go 1.16
 
 require (
 	github.com/grafana/grafana-plugin-sdk-go v0.114.0
-	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
-	github.com/sv/kdbgo v0.20.0 // indirect
+	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
+	github.com/sv/kdbgo v0.20.0
 )
@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	kdb "github.com/sv/kdbgo"
+)
+
+// AdhocFilter is one of the dashboard's ad-hoc filters, with the kdb+ type to cast its value to
+type AdhocFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+	Type     string `json:"type"`
+}
+
+// TagKey is a column which can be used in an ad-hoc filter
+type TagKey struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// TagValue is a value an ad-hoc filter can compare a column to
+type TagValue struct {
+	Text string `json:"text"`
+}
+
+// kdbArgTypes maps kdb+ type characters (as returned by meta) to the argument type filter values are cast to
+var kdbArgTypes = map[string]string{
+	"b": argTypeBoolean,
+	"i": argTypeInt,
+	"j": argTypeLong,
+	"f": argTypeFloat,
+	"s": argTypeSymbol,
+	"p": argTypeTimestamp,
+}
+
+// buildFiltersKdbTable converts ad-hoc filters to a table of Key, Operator and Value, each value being cast to
+// its filter's type. Regex filters (=~ and !~) always have string values.
+func buildFiltersKdbTable(filters []AdhocFilter) (*kdb.K, error) {
+	keys := make([]string, len(filters))
+	operators := make([]string, len(filters))
+	values := make([]*kdb.K, len(filters))
+	for i, f := range filters {
+		arg := QueryArgument{Type: f.Type, Value: f.Value}
+		if arg.Type == "" || strings.HasSuffix(f.Operator, "~") {
+			arg.Type = argTypeString
+		}
+		v, err := arg.toK()
+		if err != nil {
+			return nil, fmt.Errorf("Ad-hoc filter on %v: %v", f.Key, err)
+		}
+		keys[i] = f.Key
+		operators[i] = f.Operator
+		values[i] = v
+	}
+	return kdb.NewTable([]string{"Key", "Operator", "Value"}, []*kdb.K{kdb.SymbolV(keys), kdb.SymbolV(operators), kdb.NewList(values...)}), nil
+}
+
+// handleTagKeys returns the columns of a table, with the type filters on each should be cast to
+func (d *KdbDatasource) handleTagKeys(w http.ResponseWriter, r *http.Request) {
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		writeResourceError(w, http.StatusBadRequest, fmt.Errorf("No table given"))
+		return
+	}
+	res, err := d.runResourceQuery(r, "TAGKEYS", kdb.NewList(kdb.Symbol(".q.meta"), kdb.Symbol(table)))
+	if err != nil {
+		writeResourceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// meta is keyed on column name, with the type character in column t
+	meta, ok := res.Data.(kdb.Dict)
+	if res.Type != kdb.XD || !ok || meta.Key.Type != kdb.XT || meta.Value.Type != kdb.XT {
+		writeResourceError(w, http.StatusInternalServerError, fmt.Errorf("Expected meta of %v to be a keyed table", table))
+		return
+	}
+	cols := kdbColumnStrings(meta.Key.Data.(kdb.Table).Data[0])
+	types := make([]string, len(cols))
+	valueTable := meta.Value.Data.(kdb.Table)
+	for i, name := range valueTable.Columns {
+		if name == "t" {
+			types = kdbColumnStrings(valueTable.Data[i])
+		}
+	}
+	keys := make([]TagKey, len(cols))
+	for i, col := range cols {
+		argType, ok := kdbArgTypes[types[i]]
+		if !ok {
+			argType = argTypeString
+		}
+		keys[i] = TagKey{Text: col, Type: argType}
+	}
+	writeResourceJSON(w, http.StatusOK, keys)
+}
+
+// handleTagValues returns the distinct values of a column in a table
+func (d *KdbDatasource) handleTagValues(w http.ResponseWriter, r *http.Request) {
+	table := r.URL.Query().Get("table")
+	key := r.URL.Query().Get("key")
+	if table == "" || key == "" {
+		writeResourceError(w, http.StatusBadRequest, fmt.Errorf("Both table and key must be given"))
+		return
+	}
+	// ?[table;();1b;(enlist key)!enlist key] selects the distinct values of the column
+	sel := kdb.NewList(kdbDyad('?'), kdb.Symbol(table), kdb.NewList(), kdb.Atom(-kdb.KB, true),
+		kdb.NewDict(kdb.SymbolV([]string{key}), kdb.SymbolV([]string{key})))
+	res, err := d.runResourceQuery(r, "TAGVALUES", sel)
+	if err != nil {
+		writeResourceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	tbl, ok := res.Data.(kdb.Table)
+	if res.Type != kdb.XT || !ok || len(tbl.Data) != 1 {
+		writeResourceError(w, http.StatusInternalServerError, fmt.Errorf("Expected a single column table of values"))
+		return
+	}
+	strs := kdbColumnStrings(tbl.Data[0])
+	values := make([]TagValue, len(strs))
+	for i, s := range strs {
+		values[i] = TagValue{Text: s}
+	}
+	writeResourceJSON(w, http.StatusOK, values)
+}
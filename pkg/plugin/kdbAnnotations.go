@@ -0,0 +1,117 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	kdb "github.com/sv/kdbgo"
+)
+
+// queryTypeAnnotation is the Grafana query type of annotation queries
+const queryTypeAnnotation = "annotation"
+
+// defaultTimeColumn is the time column of annotation and log tables when there is no temporal column override
+const defaultTimeColumn = "time"
+
+// ParseAnnotationKdbTable converts a table of events to an annotation frame of time, timeEnd, title, text and
+// tags fields. Only the time column and one of title or text are required; other columns are dropped. Tags may
+// be a symbol, a symbol list or a comma-separated string per event, and are given to Grafana comma-separated.
+func ParseAnnotationKdbTable(res *kdb.K, timeColumn string) (*data.Frame, error) {
+	tbl, ok := res.Data.(kdb.Table)
+	if res.Type != kdb.XT || !ok {
+		return nil, fmt.Errorf("Annotation queries must return an unkeyed table")
+	}
+	if timeColumn == "" {
+		timeColumn = defaultTimeColumn
+	}
+	cols := map[string]*kdb.K{}
+	for i, name := range tbl.Columns {
+		cols[name] = tbl.Data[i]
+	}
+	col, ok := cols[timeColumn]
+	if !ok {
+		return nil, fmt.Errorf("Annotation table has no time column '%v'", timeColumn)
+	}
+	times, err := timeColumnValues(timeColumn, col)
+	if err != nil {
+		return nil, err
+	}
+	frame := data.NewFrame("annotations", data.NewField("time", nil, times))
+	if col, ok := cols["timeEnd"]; ok {
+		timeEnds, err := timeColumnValues("timeEnd", col)
+		if err != nil {
+			return nil, err
+		}
+		frame.Fields = append(frame.Fields, data.NewField("timeEnd", nil, timeEnds))
+	}
+	_, hasTitle := cols["title"]
+	_, hasText := cols["text"]
+	if !hasTitle && !hasText {
+		return nil, fmt.Errorf("Annotation table must have a title or text column")
+	}
+	for _, name := range []string{"title", "text"} {
+		if col, ok := cols[name]; ok {
+			strs, err := stringColumnValues(name, col)
+			if err != nil {
+				return nil, err
+			}
+			frame.Fields = append(frame.Fields, data.NewField(name, nil, strs))
+		}
+	}
+	if col, ok := cols["tags"]; ok {
+		tags, err := annotationTags(col)
+		if err != nil {
+			return nil, err
+		}
+		frame.Fields = append(frame.Fields, data.NewField("tags", nil, tags))
+	}
+	return frame, nil
+}
+
+func timeColumnValues(name string, col *kdb.K) ([]time.Time, error) {
+	switch col.Type {
+	case kdb.KP, kdb.KZ, kdb.KD:
+		return col.Data.([]time.Time), nil
+	}
+	return nil, fmt.Errorf("Column '%v' must be timestamps, datetimes or dates, received type %v", name, col.Type)
+}
+
+// stringColumnValues formats a column as strings, allowing only string columns among general lists
+func stringColumnValues(name string, col *kdb.K) ([]string, error) {
+	if col.Type == kdb.K0 {
+		strs, err := stringParser(col)
+		if err != nil {
+			return nil, fmt.Errorf("Column '%v': %v", name, err)
+		}
+		return strs, nil
+	}
+	return kdbColumnStrings(col), nil
+}
+
+func annotationTags(col *kdb.K) ([]string, error) {
+	if col.Type != kdb.K0 {
+		return kdbColumnStrings(col), nil
+	}
+	rows := col.Data.([]*kdb.K)
+	tags := make([]string, len(rows))
+	for i, row := range rows {
+		switch row.Type {
+		case kdb.KS:
+			tags[i] = strings.Join(row.Data.([]string), ",")
+		case -kdb.KS, kdb.KC:
+			tags[i] = row.Data.(string)
+		case kdb.K0:
+			// an empty list, or a list of strings
+			strs, err := stringParser(row)
+			if err != nil {
+				return nil, fmt.Errorf("Annotation tags at index %v: %v", i, err)
+			}
+			tags[i] = strings.Join(strs, ",")
+		default:
+			return nil, fmt.Errorf("Annotation tags at index %v must be symbols or strings, received type %v", i, row.Type)
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,120 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	kdb "github.com/sv/kdbgo"
+)
+
+// asyncQueryWrapper evaluates the (function;dict) query sent to it and posts the result back asynchronously,
+// tagged with the correlation id from the dict and a flag indicating whether evaluation signalled an error
+const asyncQueryWrapper = "{[f;x] neg[.z.w] (x`CorrelationID),@[{(0b;value(x;y))}[f];x;{(1b;x)}]}"
+
+// buildAsyncKdbQuery adds the correlation id to the dict of a (function;dict) query and wraps it for async evaluation
+func buildAsyncKdbQuery(query *kdb.K, id uint32) (*kdb.K, error) {
+	parts, ok := query.Data.([]*kdb.K)
+	if query.Type != kdb.K0 || !ok || len(parts) != 2 || parts[1].Type != kdb.XD {
+		return nil, fmt.Errorf("Async queries must be a (function;dict) list")
+	}
+	dict := parts[1].Data.(kdb.Dict)
+	keys := append(append([]string{}, dict.Key.Data.([]string)...), "CorrelationID")
+	values := append(append([]*kdb.K{}, dict.Value.Data.([]*kdb.K)...), kdb.Long(int64(id)))
+	return kdb.NewList(
+		kdb.Atom(kdb.KC, asyncQueryWrapper),
+		parts[0],
+		kdb.NewDict(kdb.SymbolV(keys), kdb.NewList(values...))), nil
+}
+
+func (h *kdbHandle) addPending(query *kdbSyncQuery) {
+	h.pendingLock.Lock()
+	defer h.pendingLock.Unlock()
+	if h.pending == nil {
+		h.pending = make(map[uint32]*kdbSyncQuery)
+	}
+	query.replied = make(chan struct{})
+	h.pending[query.id] = query
+}
+
+// takePending removes and returns the waiter for an id, if it is still waiting
+func (h *kdbHandle) takePending(id uint32) (*kdbSyncQuery, bool) {
+	h.pendingLock.Lock()
+	defer h.pendingLock.Unlock()
+	query, ok := h.pending[id]
+	if ok {
+		delete(h.pending, id)
+		close(query.replied)
+	}
+	return query, ok
+}
+
+// failPending returns err to every query still waiting on the handle
+func (h *kdbHandle) failPending(err error) {
+	h.pendingLock.Lock()
+	defer h.pendingLock.Unlock()
+	for id, query := range h.pending {
+		close(query.replied)
+		query.resChan <- &kdbSyncRes{result: nil, err: err, id: id}
+	}
+	h.pending = nil
+}
+
+// runKdbQueryAsync sends a query as an async message and leaves the reply to be routed by kdbHandleListener,
+// so that further queries can be sent on the handle while it is in flight
+func (d *KdbDatasource) runKdbQueryAsync(h *kdbHandle, query *kdbSyncQuery) {
+	msg, err := buildAsyncKdbQuery(query.query, query.id)
+	if err != nil {
+		query.resChan <- &kdbSyncRes{result: nil, err: err, id: query.id}
+		return
+	}
+	h.addPending(query)
+	err = d.WriteConnection(h, kdb.ASYNC, msg)
+	if err != nil {
+		log.DefaultLogger.Error("Error writing async message", err.Error())
+		if _, ok := h.takePending(query.id); ok {
+			query.resChan <- &kdbSyncRes{result: nil, err: err, id: query.id}
+		}
+		return
+	}
+	go d.awaitAsyncReply(h, query)
+}
+
+// awaitAsyncReply abandons an async query if it times out or is cancelled before its reply is routed
+func (d *KdbDatasource) awaitAsyncReply(h *kdbHandle, query *kdbSyncQuery) {
+	var err error
+	select {
+	case <-query.replied:
+		return
+	case <-time.After(query.timeout):
+		err = fmt.Errorf("Queried timed out after %v", query.timeout)
+	case <-query.ctx.Done():
+		err = query.ctx.Err()
+	}
+	if _, ok := h.takePending(query.id); ok {
+		log.DefaultLogger.Debug(fmt.Sprintf("Abandoning async query %v on handle %v: %v", query.id, h.id, err))
+		query.resChan <- &kdbSyncRes{result: nil, err: err, id: query.id}
+	}
+}
+
+// routeAsyncReply passes an (id;isError;result) reply to the query waiting on that id
+func (d *KdbDatasource) routeAsyncReply(h *kdbHandle, msg *kdb.K) {
+	parts, ok := msg.Data.([]*kdb.K)
+	if msg.Type != kdb.K0 || !ok || len(parts) != 3 || parts[0].Type != -kdb.KJ || parts[1].Type != -kdb.KB {
+		log.DefaultLogger.Debug(fmt.Sprintf("Ignoring uncorrelated async message on handle %v", h.id))
+		return
+	}
+	id := uint32(parts[0].Data.(int64))
+	query, ok := h.takePending(id)
+	if !ok {
+		log.DefaultLogger.Debug(fmt.Sprintf("Discarding reply to abandoned async query %v", id))
+		return
+	}
+	if parts[1].Data.(bool) {
+		errMsg, _ := parts[2].Data.(string)
+		query.resChan <- &kdbSyncRes{result: nil, err: errors.New(errMsg), id: id}
+		return
+	}
+	query.resChan <- &kdbSyncRes{result: parts[2], err: nil, id: id}
+}
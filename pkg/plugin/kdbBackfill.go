@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// streamPathBackfill is the first part of the channel path of backfilled tickerplant subscriptions,
+// backfill/<hash of the query>
+const streamPathBackfill = "backfill"
+
+// registerBackfillStream records the historical query run before a tickerplant subscription, returning its
+// channel path
+func (d *KdbDatasource) registerBackfillStream(pCtx backend.PluginContext, query backend.DataQuery, model QueryModel) (string, error) {
+	s := model.Stream
+	if s.Table == "" {
+		return "", fmt.Errorf("No table given to stream")
+	}
+	column := s.SequenceColumn
+	if column == "" {
+		column = s.TimeColumn
+	}
+	if column == "" {
+		column = defaultTimeColumn
+	}
+	if s.Syms == nil {
+		s.Syms = []string{}
+	}
+	return d.registerStream(streamPathBackfill, pCtx, query, model, &kdbRegisteredStream{timeColumn: column, stream: s})
+}
+
+// backfillFrame runs the historical query of a backfilled stream for a new subscriber, returning its result as
+// the subscription's initial data. Grafana runs one stream per channel, so each subscriber is backfilled as it
+// subscribes rather than by the stream. The watermark of the first subscribers, which subscribe before the stream
+// starts, is kept so that the stream pushes them only what their initial data is missing. A failed query is logged
+// and the subscriber starts with live updates alone.
+func (d *KdbDatasource) backfillFrame(ctx context.Context, rs *kdbRegisteredStream) (*backend.InitialData, error) {
+	res := d.safeQuery(ctx, rs.pCtx, rs.dataQuery(time.Now()))
+	if res.Error != nil {
+		log.DefaultLogger.Error(fmt.Sprintf("Error backfilling stream of %v: %v", rs.stream.Table, res.Error))
+		return nil, nil
+	}
+	if len(res.Frames) != 1 {
+		log.DefaultLogger.Error(fmt.Sprintf("Backfill of %v must return a single table, returned %v frames", rs.stream.Table, len(res.Frames)))
+		return nil, nil
+	}
+	frame := res.Frames[0]
+	mark := &streamWatermark{column: rs.timeColumn}
+	if err := mark.advance(frame); err != nil {
+		log.DefaultLogger.Error(fmt.Sprintf("Backfill of %v cannot be de-duplicated: %v", rs.stream.Table, err))
+		mark = nil
+	}
+	d.registeredStreams.lock.Lock()
+	if rs.running == 0 && mark != nil && mark.set && (rs.backfillMark == nil || mark.before(rs.backfillMark)) {
+		rs.backfillMark = mark
+	}
+	d.registeredStreams.lock.Unlock()
+	return backend.NewInitialFrame(frame, data.IncludeAll)
+}
+
+// sendBackfill runs the historical query of a backfilled stream once it has subscribed to the tickerplant, pushing
+// the rows its first subscribers' initial data is missing, as published between their query and the subscription.
+// It returns the latest sequence number or time pushed so that updates already in the result are not pushed again.
+// A failed query is logged and the stream carries on with live updates alone.
+func (d *KdbDatasource) sendBackfill(ctx context.Context, rs *kdbRegisteredStream, sender frameSender) (*streamWatermark, error) {
+	d.registeredStreams.lock.Lock()
+	initial := rs.backfillMark
+	rs.backfillMark = nil
+	d.registeredStreams.lock.Unlock()
+	res := d.safeQuery(ctx, rs.pCtx, rs.dataQuery(time.Now()))
+	if res.Error != nil {
+		if ctx.Err() == nil {
+			log.DefaultLogger.Error(fmt.Sprintf("Error backfilling stream of %v: %v", rs.stream.Table, res.Error))
+		}
+		return initial, nil
+	}
+	mark := &streamWatermark{column: rs.timeColumn}
+	if initial != nil {
+		*mark = *initial
+	}
+	for _, frame := range res.Frames {
+		rows := frame
+		if mark != nil {
+			var err error
+			if rows, err = mark.newRows(frame); err == nil {
+				err = mark.advance(frame)
+			}
+			if err != nil {
+				log.DefaultLogger.Error(fmt.Sprintf("Backfill of %v cannot be de-duplicated: %v", rs.stream.Table, err))
+				mark = nil
+				rows = frame
+			}
+		}
+		if rows.Rows() == 0 {
+			continue
+		}
+		if err := sender.SendFrame(rows, data.IncludeAll); err != nil {
+			return nil, err
+		}
+	}
+	if mark == nil || !mark.set {
+		return nil, nil
+	}
+	return mark, nil
+}
+
+// streamWatermark is the latest value of a sequence number or time column among the rows already pushed to a
+// stream
+type streamWatermark struct {
+	column string
+	set    bool
+	time   time.Time
+	seq    float64
+}
+
+func (w *streamWatermark) field(frame *data.Frame) (*data.Field, error) {
+	idx := fieldIndex(frame, w.column)
+	if idx < 0 {
+		return nil, fmt.Errorf("Stream result has no column '%v'", w.column)
+	}
+	field := frame.Fields[idx]
+	if !field.Type().Time() && !field.Type().Numeric() {
+		return nil, fmt.Errorf("Stream column '%v' must be a sequence number or time, received %v", w.column, field.Type())
+	}
+	return field, nil
+}
+
+// after is whether row i of field is later than the watermark
+func (w *streamWatermark) after(field *data.Field, i int) bool {
+	if !w.set {
+		return true
+	}
+	if field.Type().Time() {
+		t, ok := field.ConcreteAt(i)
+		return ok && t.(time.Time).After(w.time)
+	}
+	seq, err := field.FloatAt(i)
+	return err == nil && seq > w.seq
+}
+
+// advance moves the watermark to the latest value in the frame
+func (w *streamWatermark) advance(frame *data.Frame) error {
+	field, err := w.field(frame)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < field.Len(); i++ {
+		if !w.after(field, i) {
+			continue
+		}
+		if field.Type().Time() {
+			t, ok := field.ConcreteAt(i)
+			if !ok {
+				continue
+			}
+			w.time = t.(time.Time)
+		} else {
+			seq, err := field.FloatAt(i)
+			if err != nil || math.IsNaN(seq) {
+				continue
+			}
+			w.seq = seq
+		}
+		w.set = true
+	}
+	return nil
+}
+
+// before is whether the watermark is earlier than another of the same column
+func (w *streamWatermark) before(other *streamWatermark) bool {
+	if !w.time.IsZero() || !other.time.IsZero() {
+		return w.time.Before(other.time)
+	}
+	return w.seq < other.seq
+}
+
+// newRows returns the rows of the frame later than the watermark
+func (w *streamWatermark) newRows(frame *data.Frame) (*data.Frame, error) {
+	field, err := w.field(frame)
+	if err != nil {
+		return nil, err
+	}
+	return filterFrameRows(frame, func(i int) bool { return w.after(field, i) }), nil
+}
@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	defaultReconnectBackoffMin = time.Second
+	defaultReconnectBackoffMax = time.Minute
+	defaultBreakerThreshold    = 1
+)
+
+// kdbBreaker is a circuit breaker on opening handles to an endpoint. Once threshold consecutive
+// connection attempts have failed the breaker opens and queries fail fast until an exponentially
+// increasing, jittered backoff has elapsed; a single trial connection is then allowed through.
+type kdbBreaker struct {
+	threshold  int
+	backoffMin time.Duration
+	backoffMax time.Duration
+	failures   int
+	openUntil  time.Time
+	trial      bool
+	lock       sync.Mutex
+}
+
+func newKdbBreaker(threshold int, backoffMin time.Duration, backoffMax time.Duration) *kdbBreaker {
+	if threshold < 1 {
+		threshold = defaultBreakerThreshold
+	}
+	if backoffMin <= 0 {
+		backoffMin = defaultReconnectBackoffMin
+	}
+	if backoffMax < backoffMin {
+		backoffMax = defaultReconnectBackoffMax
+		if backoffMax < backoffMin {
+			backoffMax = backoffMin
+		}
+	}
+	return &kdbBreaker{threshold: threshold, backoffMin: backoffMin, backoffMax: backoffMax}
+}
+
+// allow reports whether a connection attempt may be made, or else how long until the next attempt
+func (b *kdbBreaker) allow() (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < b.threshold {
+		return 0, true
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return wait, false
+	}
+	// half-open: let one connection attempt through while the others keep failing fast
+	if b.trial {
+		return b.backoffMin, false
+	}
+	b.trial = true
+	return 0, true
+}
+
+// isOpen reports whether the breaker is failing queries fast, without taking the half-open trial
+func (b *kdbBreaker) isOpen() (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < b.threshold {
+		return 0, false
+	}
+	wait := time.Until(b.openUntil)
+	return wait, wait > 0
+}
+
+func (b *kdbBreaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *kdbBreaker) failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures += 1
+	b.trial = false
+	if b.failures < b.threshold {
+		return
+	}
+	backoff := b.backoffMax
+	if shift := b.failures - b.threshold; shift < 32 {
+		if d := b.backoffMin << uint(shift); d > 0 && d < b.backoffMax {
+			backoff = d
+		}
+	}
+	// equal jitter: wait between half and all of the backoff
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	b.openUntil = time.Now().Add(backoff)
+	log.DefaultLogger.Debug(fmt.Sprintf("Circuit breaker open after %v consecutive failures, retrying in %v", b.failures, backoff))
+}
+
+// openHandle opens a handle subject to its pool's circuit breaker
+func (d *KdbDatasource) openHandle(h *kdbHandle) error {
+	b := h.pool.breaker
+	if wait, ok := b.allow(); !ok {
+		return kdbUnavailableError(wait)
+	}
+	err := d.OpenConnection(h)
+	if err != nil {
+		// kdb+ closing the connection during the handshake of a passed-through user means .z.pw refused them
+		if h.pool.user != "" && errors.Is(err, io.EOF) {
+			b.success()
+			return &kdbUserRejectedError{user: h.pool.user, err: err}
+		}
+		b.failure()
+		return err
+	}
+	b.success()
+	return nil
+}
+
+// kdbUnavailableError is returned to queries while an endpoint's circuit breaker is open
+func kdbUnavailableError(wait time.Duration) error {
+	return fmt.Errorf("kdb+ unavailable, retrying in %v", wait.Round(100*time.Millisecond))
+}
@@ -0,0 +1,405 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	conflationLatest = "latest"
+	conflationOHLC   = "ohlc"
+)
+
+const (
+	defaultConflationInterval = time.Second
+	defaultSymColumn          = "sym"
+	defaultPriceColumn        = "price"
+	// maxStreamFPS is the highest maxFps accepted, above which a browser could not draw frames anyway
+	maxStreamFPS = 1000
+)
+
+// StreamConflation reduces what a stream pushes: to the latest row of each sym, or to OHLC bars of each sym, every
+// ConflationInterval milliseconds, and to at most MaxFPS frames a second
+type StreamConflation struct {
+	Conflation         string `json:"conflation"`
+	ConflationInterval int    `json:"conflationInterval"`
+	MaxFPS             int    `json:"maxFps"`
+	SymColumn          string `json:"symColumn"`
+	PriceColumn        string `json:"priceColumn"`
+	SizeColumn         string `json:"sizeColumn"`
+}
+
+func (c *StreamConflation) validate() error {
+	switch c.Conflation {
+	case "", conflationLatest, conflationOHLC:
+	default:
+		return fmt.Errorf("Unsupported conflation '%v'", c.Conflation)
+	}
+	if c.ConflationInterval < 0 || c.MaxFPS < 0 {
+		return fmt.Errorf("Conflation interval and maximum frames per second may not be negative")
+	}
+	if c.MaxFPS > maxStreamFPS {
+		return fmt.Errorf("Maximum frames per second may not be more than %v", maxStreamFPS)
+	}
+	return nil
+}
+
+// pathOptions are the options set, as <option>=<value> parts of a channel path
+func (c *StreamConflation) pathOptions() []string {
+	options := []string{}
+	add := func(name string, value string) {
+		if value != "" && value != "0" {
+			options = append(options, name+"="+value)
+		}
+	}
+	add("conflation", c.Conflation)
+	add("conflationInterval", strconv.Itoa(c.ConflationInterval))
+	add("maxFps", strconv.Itoa(c.MaxFPS))
+	add("symColumn", c.SymColumn)
+	add("priceColumn", c.PriceColumn)
+	add("sizeColumn", c.SizeColumn)
+	return options
+}
+
+// setPathOption sets an option read from a channel path
+func (c *StreamConflation) setPathOption(name string, value string) error {
+	var err error
+	switch name {
+	case "conflation":
+		c.Conflation = value
+	case "conflationInterval":
+		c.ConflationInterval, err = strconv.Atoi(value)
+	case "maxFps":
+		c.MaxFPS, err = strconv.Atoi(value)
+	case "symColumn":
+		c.SymColumn = value
+	case "priceColumn":
+		c.PriceColumn = value
+	case "sizeColumn":
+		c.SizeColumn = value
+	default:
+		return fmt.Errorf("Unknown option '%v'", name)
+	}
+	if err != nil {
+		return fmt.Errorf("Option '%v' must be an integer", name)
+	}
+	return c.validate()
+}
+
+// frameSender is where streams push frames; a StreamSender, or a kdbConflator in front of one
+type frameSender interface {
+	SendFrame(frame *data.Frame, include data.FrameInclude) error
+}
+
+// kdbConflator holds the frames a stream pushes and sends them to Grafana Live every period, reduced to the
+// latest row of each sym or to the OHLC bars which have closed. Bars close on the rows' own timestamps, so do not
+// depend on the clocks of the server and the tickerplant agreeing.
+type kdbConflator struct {
+	mode        string
+	interval    time.Duration
+	period      time.Duration
+	symColumn   string
+	timeColumn  string
+	priceColumn string
+	sizeColumn  string
+	sender      frameSender
+	lock        sync.Mutex
+	pending     []*data.Frame
+	bars        *ohlcBars
+	schema      string
+	err         error
+}
+
+// newStreamConflator is the conflator of a stream's options, or nil if the stream is not conflated
+func newStreamConflator(s *StreamQuery, sender frameSender) *kdbConflator {
+	if s.Conflation == "" && s.MaxFPS <= 0 {
+		return nil
+	}
+	c := &kdbConflator{
+		mode:        s.Conflation,
+		interval:    defaultConflationInterval,
+		symColumn:   s.SymColumn,
+		timeColumn:  s.TimeColumn,
+		priceColumn: s.PriceColumn,
+		sizeColumn:  s.SizeColumn,
+		sender:      sender,
+	}
+	if s.ConflationInterval > 0 {
+		c.interval = time.Duration(s.ConflationInterval) * time.Millisecond
+	}
+	if c.symColumn == "" {
+		c.symColumn = defaultSymColumn
+	}
+	if c.timeColumn == "" {
+		c.timeColumn = defaultTimeColumn
+	}
+	if c.priceColumn == "" {
+		c.priceColumn = defaultPriceColumn
+	}
+	c.period = c.interval
+	switch c.mode {
+	case conflationOHLC:
+		// bars are sent once closed, so are checked more often than they close
+		if c.period > time.Second {
+			c.period = time.Second
+		}
+		c.bars = &ohlcBars{open: map[string]*ohlcBar{}, closedUntil: map[string]time.Time{}}
+	case "":
+		c.period = 0
+	}
+	if s.MaxFPS > 0 {
+		if limit := time.Second / time.Duration(s.MaxFPS); limit > c.period {
+			c.period = limit
+		}
+	}
+	if c.period < time.Millisecond {
+		c.period = time.Millisecond
+	}
+	return c
+}
+
+// SendFrame holds a frame until the next period, returning any error sending earlier frames
+func (c *kdbConflator) SendFrame(frame *data.Frame, _ data.FrameInclude) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if c.mode == conflationOHLC {
+		return c.bars.add(frame, c)
+	}
+	// frames with the schema of the last held frame are merged into it; others are sent separately
+	schema := frameSchema(frame)
+	if n := len(c.pending); n > 0 && frameSchema(c.pending[n-1]) == schema {
+		last := c.pending[n-1]
+		rows, _ := frame.RowLen()
+		for i := 0; i < rows; i++ {
+			last.AppendRow(frame.RowCopy(i)...)
+		}
+		return nil
+	}
+	// copied, as the stream may keep the frame
+	c.pending = append(c.pending, filterFrameRows(frame, func(int) bool { return true }))
+	return nil
+}
+
+// run sends the frames held every period until the stream ends
+func (c *kdbConflator) run(ctx context.Context) {
+	ticker := time.NewTicker(c.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.flush(); err != nil {
+				c.lock.Lock()
+				c.err = err
+				c.lock.Unlock()
+				return
+			}
+		}
+	}
+}
+
+func (c *kdbConflator) flush() error {
+	c.lock.Lock()
+	frames := c.pending
+	c.pending = nil
+	switch c.mode {
+	case conflationLatest:
+		for i, frame := range frames {
+			frames[i] = latestRows(frame, c.symColumn)
+		}
+	case conflationOHLC:
+		frames = []*data.Frame{c.bars.closed(c)}
+	}
+	c.lock.Unlock()
+
+	for _, frame := range frames {
+		if frame.Rows() == 0 {
+			continue
+		}
+		// the schema is sent whenever it changes, which for a tickerplant is only with the first frame
+		include := data.IncludeDataOnly
+		if schema := frameSchema(frame); schema != c.schema {
+			include = data.IncludeAll
+			c.schema = schema
+		}
+		if err := c.sender.SendFrame(frame, include); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// frameSchema identifies frames which can be merged by their name and their fields' names and types
+func frameSchema(frame *data.Frame) string {
+	parts := []string{frame.Name}
+	for _, field := range frame.Fields {
+		parts = append(parts, field.Name, field.Type().ItemTypeString())
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// latestRows keeps the last row of each sym of a frame, or its last row if it has no sym column
+func latestRows(frame *data.Frame, symColumn string) *data.Frame {
+	rows, _ := frame.RowLen()
+	idx := fieldIndex(frame, symColumn)
+	if idx < 0 {
+		return filterFrameRows(frame, func(i int) bool { return i == rows-1 })
+	}
+	field := frame.Fields[idx]
+	last := map[string]int{}
+	for i := 0; i < rows; i++ {
+		last[fmt.Sprint(field.At(i))] = i
+	}
+	return filterFrameRows(frame, func(i int) bool { return last[fmt.Sprint(field.At(i))] == i })
+}
+
+// ohlcBar is the open, high, low and close price and the volume of a sym over an interval from start
+type ohlcBar struct {
+	sym                            string
+	start                          time.Time
+	open, high, low, close, volume float64
+}
+
+// ohlcBars holds the open bar of each sym, the end of the last bar closed, before which rows are too late, and
+// the start of the latest bar of any sym, which bars of every sym before it have been passed by
+type ohlcBars struct {
+	open        map[string]*ohlcBar
+	syms        []string
+	done        []*ohlcBar
+	closedUntil map[string]time.Time
+	latest      time.Time
+	name        string
+	hasSym      bool
+	hasSize     bool
+}
+
+// add adds the rows of a frame to the bars of their syms, closing bars which later rows are past
+func (b *ohlcBars) add(frame *data.Frame, c *kdbConflator) error {
+	column := func(name string, numeric bool) (*data.Field, error) {
+		idx := fieldIndex(frame, name)
+		if idx < 0 {
+			return nil, fmt.Errorf("Stream has no column '%v' for OHLC bars", name)
+		}
+		field := frame.Fields[idx]
+		if numeric && !field.Type().Numeric() {
+			return nil, fmt.Errorf("Stream column '%v' must be numeric for OHLC bars", name)
+		}
+		if !numeric && !field.Type().Time() {
+			return nil, fmt.Errorf("Stream column '%v' must be temporal for OHLC bars", name)
+		}
+		return field, nil
+	}
+	times, err := column(c.timeColumn, false)
+	if err != nil {
+		return err
+	}
+	prices, err := column(c.priceColumn, true)
+	if err != nil {
+		return err
+	}
+	var sizes, syms *data.Field
+	if c.sizeColumn != "" {
+		if sizes, err = column(c.sizeColumn, true); err != nil {
+			return err
+		}
+	}
+	if idx := fieldIndex(frame, c.symColumn); idx >= 0 {
+		syms = frame.Fields[idx]
+	}
+	b.name, b.hasSym, b.hasSize = frame.Name, syms != nil, sizes != nil
+
+	for i := 0; i < times.Len(); i++ {
+		t, ok := times.ConcreteAt(i)
+		price, err := prices.FloatAt(i)
+		if !ok || err != nil || math.IsNaN(price) {
+			continue
+		}
+		size := 0.0
+		if sizes != nil {
+			if size, err = sizes.FloatAt(i); err != nil || math.IsNaN(size) {
+				size = 0
+			}
+		}
+		sym := ""
+		if syms != nil {
+			sym = fmt.Sprint(syms.At(i))
+		}
+		start := t.(time.Time).Truncate(c.interval)
+		if start.Before(b.closedUntil[sym]) {
+			log.DefaultLogger.Debug(fmt.Sprintf("Dropping row of %v at %v after its bar was sent", sym, t))
+			continue
+		}
+		if start.After(b.latest) {
+			b.latest = start
+		}
+		bar, ok := b.open[sym]
+		if ok && start.After(bar.start) {
+			b.close(bar, c.interval)
+			ok = false
+		}
+		if !ok {
+			if _, seen := b.closedUntil[sym]; !seen {
+				b.syms = append(b.syms, sym)
+			}
+			b.open[sym] = &ohlcBar{sym: sym, start: start, open: price, high: price, low: price, close: price, volume: size}
+			b.closedUntil[sym] = start
+			continue
+		}
+		bar.high = math.Max(bar.high, price)
+		bar.low = math.Min(bar.low, price)
+		bar.close = price
+		bar.volume += size
+	}
+	return nil
+}
+
+func (b *ohlcBars) close(bar *ohlcBar, interval time.Duration) {
+	delete(b.open, bar.sym)
+	b.done = append(b.done, bar)
+	b.closedUntil[bar.sym] = bar.start.Add(interval)
+}
+
+// closed closes the bars before the latest row of any sym, which their interval has passed, and returns a frame
+// of the bars closed since it was last called
+func (b *ohlcBars) closed(c *kdbConflator) *data.Frame {
+	for _, sym := range b.syms {
+		if bar, ok := b.open[sym]; ok && bar.start.Before(b.latest) {
+			b.close(bar, c.interval)
+		}
+	}
+	done := b.done
+	b.done = nil
+	n := len(done)
+	starts := make([]time.Time, n)
+	syms := make([]string, n)
+	opens, highs, lows, closes, volumes := make([]float64, n), make([]float64, n), make([]float64, n), make([]float64, n), make([]float64, n)
+	for i, bar := range done {
+		starts[i], syms[i] = bar.start, bar.sym
+		opens[i], highs[i], lows[i], closes[i], volumes[i] = bar.open, bar.high, bar.low, bar.close, bar.volume
+	}
+	frame := data.NewFrame(b.name, data.NewField(c.timeColumn, nil, starts))
+	if b.hasSym {
+		frame.Fields = append(frame.Fields, data.NewField(c.symColumn, nil, syms))
+	}
+	frame.Fields = append(frame.Fields,
+		data.NewField("open", nil, opens),
+		data.NewField("high", nil, highs),
+		data.NewField("low", nil, lows),
+		data.NewField("close", nil, closes))
+	if b.hasSize {
+		frame.Fields = append(frame.Fields, data.NewField("volume", nil, volumes))
+	}
+	return frame
+}
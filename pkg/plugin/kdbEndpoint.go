@@ -0,0 +1,234 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	kdb "github.com/sv/kdbgo"
+)
+
+const defaultFailbackInterval = 30 * time.Second
+
+// load balancing strategies; failover sends every query to the first healthy endpoint
+const (
+	loadBalanceFailover         = "failover"
+	loadBalanceRoundRobin       = "roundRobin"
+	loadBalanceLeastOutstanding = "leastOutstanding"
+	loadBalanceRandom           = "random"
+)
+
+// kdbEndpoint is one kdb+ process the datasource can query, with its own pool of handles
+type kdbEndpoint struct {
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	SocketPath   string `json:"socketPath"`
+	pool         *kdbPool
+	breaker      *kdbBreaker
+	ejected      bool
+	outstanding  int32
+	userPools    map[string]*kdbPool
+	userPoolLock sync.Mutex
+}
+
+func (e *kdbEndpoint) String() string {
+	return fmt.Sprintf("%s:%v", e.Host, e.Port)
+}
+
+// socketPath is the Unix domain socket to dial for the endpoint when connecting in unix mode
+func (e *kdbEndpoint) socketPath() string {
+	if e.SocketPath != "" {
+		return e.SocketPath
+	}
+	return defaultSocketPath(e.Port)
+}
+
+// kdbConnectionError is returned when a handle cannot be opened to an endpoint, meaning the query was never sent
+type kdbConnectionError struct {
+	endpoint *kdbEndpoint
+	err      error
+}
+
+func (e *kdbConnectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kdbConnectionError) Unwrap() error {
+	return e.err
+}
+
+// isFailoverError reports whether a query should be retried on the next endpoint: either a handle could not be
+// opened, or the handle hit EOF, as a stale pooled handle does after the kdb+ process restarts
+func isFailoverError(err error) bool {
+	if _, ok := err.(*kdbConnectionError); ok {
+		return true
+	}
+	return err != nil && strings.Contains(err.Error(), kdbEOF)
+}
+
+// isLoadBalanced reports whether queries are spread across endpoints rather than failing over between them
+func (d *KdbDatasource) isLoadBalanced() bool {
+	switch d.LoadBalancing {
+	case loadBalanceRoundRobin, loadBalanceLeastOutstanding, loadBalanceRandom:
+		return len(d.Endpoints) > 1
+	}
+	return false
+}
+
+// setupEndpoints gives each configured endpoint a handle pool, treating Host and Port as the only
+// endpoint if no ordered endpoint list is configured
+func (d *KdbDatasource) setupEndpoints(minSize int, maxSize int, idleTimeout time.Duration) {
+	if len(d.Endpoints) == 0 {
+		d.Endpoints = []*kdbEndpoint{{Host: d.Host, Port: d.Port, SocketPath: d.SocketPath}}
+	}
+	for _, e := range d.Endpoints {
+		e.pool = newKdbPool(minSize, maxSize, idleTimeout)
+		e.pool.endpoint = e
+		e.breaker = newKdbBreaker(d.BreakerThreshold, d.reconnectBackoffMin, d.reconnectBackoffMax)
+		e.pool.breaker = e.breaker
+	}
+}
+
+// getActiveEndpoint returns the first healthy endpoint, which queries are routed to when failing over
+func (d *KdbDatasource) getActiveEndpoint() *kdbEndpoint {
+	d.endpointLock.Lock()
+	defer d.endpointLock.Unlock()
+	for _, e := range d.Endpoints {
+		if !e.ejected {
+			return e
+		}
+	}
+	if len(d.Endpoints) == 0 {
+		return nil
+	}
+	return d.Endpoints[0]
+}
+
+// getHealthyEndpoints returns every endpoint which has not been ejected
+func (d *KdbDatasource) getHealthyEndpoints() []*kdbEndpoint {
+	d.endpointLock.Lock()
+	defer d.endpointLock.Unlock()
+	healthy := []*kdbEndpoint{}
+	for _, e := range d.Endpoints {
+		if !e.ejected {
+			healthy = append(healthy, e)
+		}
+	}
+	return healthy
+}
+
+// endpointOrder returns the healthy endpoints in the order they should be tried under the load balancing
+// strategy, followed by any ejected endpoints as a last resort
+func (d *KdbDatasource) endpointOrder() []*kdbEndpoint {
+	d.endpointLock.Lock()
+	defer d.endpointLock.Unlock()
+	healthy := []*kdbEndpoint{}
+	ejected := []*kdbEndpoint{}
+	for _, e := range d.Endpoints {
+		if e.ejected {
+			ejected = append(ejected, e)
+		} else {
+			healthy = append(healthy, e)
+		}
+	}
+	n := len(healthy)
+	switch d.LoadBalancing {
+	case loadBalanceRoundRobin:
+		if n > 0 {
+			offset := int(atomic.AddUint32(&d.roundRobinCounter, 1) % uint32(n))
+			healthy = append(healthy[offset:], healthy[:offset]...)
+		}
+	case loadBalanceLeastOutstanding:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return atomic.LoadInt32(&healthy[i].outstanding) < atomic.LoadInt32(&healthy[j].outstanding)
+		})
+	case loadBalanceRandom:
+		rand.Shuffle(n, func(i, j int) { healthy[i], healthy[j] = healthy[j], healthy[i] })
+	}
+	return append(healthy, ejected...)
+}
+
+// ejectEndpoint stops routing queries to an endpoint until it passes a health check
+func (d *KdbDatasource) ejectEndpoint(e *kdbEndpoint) {
+	d.endpointLock.Lock()
+	defer d.endpointLock.Unlock()
+	if len(d.Endpoints) < 2 || e.ejected {
+		return
+	}
+	e.ejected = true
+	log.DefaultLogger.Warn(fmt.Sprintf("Ejecting unhealthy endpoint %v", e))
+}
+
+// reinstateEndpoint routes queries to an ejected endpoint again; when failing over this fails back to it
+// if it precedes the active endpoint
+func (d *KdbDatasource) reinstateEndpoint(e *kdbEndpoint) {
+	d.endpointLock.Lock()
+	defer d.endpointLock.Unlock()
+	if e.ejected {
+		log.DefaultLogger.Info(fmt.Sprintf("Reinstating endpoint %v", e))
+		e.ejected = false
+	}
+}
+
+// probeEndpoint runs the same 1+1 check as CheckHealth against a single endpoint
+func (d *KdbDatasource) probeEndpoint(e *kdbEndpoint) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), d.DialTimeout)
+	defer cancel()
+	res, err := d.runKdbQueryOnEndpoint(ctx, e, buildHealthCheckKdbQuery(d.healthCheckFunction(), backend.PluginContext{DataSourceInstanceSettings: d.settings}, d.DialTimeout), d.DialTimeout)
+	if err != nil || res.Type != -kdb.KJ || res.Data.(int64) != 2 {
+		return false
+	}
+	return true
+}
+
+// endpointProbeRunner periodically re-probes ejected endpoints, reinstating any which respond correctly
+func (d *KdbDatasource) endpointProbeRunner() {
+	for {
+		select {
+		case _, ok := <-d.signals:
+			if !ok {
+				log.DefaultLogger.Debug("Returning from endpoint probe runner")
+				return
+			}
+		case <-time.After(d.failbackInterval):
+			for _, e := range d.Endpoints {
+				d.endpointLock.Lock()
+				ejected := e.ejected
+				d.endpointLock.Unlock()
+				if !ejected {
+					continue
+				}
+				log.DefaultLogger.Debug(fmt.Sprintf("Probing ejected endpoint %v", e))
+				if d.probeEndpoint(e) {
+					d.reinstateEndpoint(e)
+				} else {
+					log.DefaultLogger.Debug(fmt.Sprintf("Endpoint %v still unavailable", e))
+				}
+			}
+		}
+	}
+}
+
+// runKdbQuerySync runs a query against the endpoint chosen by the load balancing strategy, ejecting it and
+// trying the next endpoint if a handle cannot be opened or is found to be closed
+func (d *KdbDatasource) runKdbQuerySync(ctx context.Context, query *kdb.K, timeout time.Duration) (*kdb.K, error) {
+	var err error
+	for _, e := range d.endpointOrder() {
+		var res *kdb.K
+		atomic.AddInt32(&e.outstanding, 1)
+		res, err = d.runKdbQueryOnEndpoint(ctx, e, query, timeout)
+		atomic.AddInt32(&e.outstanding, -1)
+		if !isFailoverError(err) {
+			return res, err
+		}
+		d.ejectEndpoint(e)
+	}
+	return nil, err
+}
@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	kdb "github.com/sv/kdbgo"
+)
+
+// query modes; text queries evaluate QueryText whereas function queries call a named function with typed arguments
+const (
+	queryModeText     = "text"
+	queryModeFunction = "function"
+)
+
+// kdb+ types function arguments can be declared as
+const (
+	argTypeBoolean       = "boolean"
+	argTypeInt           = "int"
+	argTypeLong          = "long"
+	argTypeFloat         = "float"
+	argTypeSymbol        = "symbol"
+	argTypeString        = "string"
+	argTypeTimestamp     = "timestamp"
+	argTypeBooleanList   = "booleanList"
+	argTypeIntList       = "intList"
+	argTypeLongList      = "longList"
+	argTypeFloatList     = "floatList"
+	argTypeSymbolList    = "symbolList"
+	argTypeStringList    = "stringList"
+	argTypeTimestampList = "timestampList"
+)
+
+// kdbTimestampFormat is the kdb+ text representation of a timestamp
+const kdbTimestampFormat = "2006.01.02D15:04:05.999999999"
+
+// QueryArgument is a single typed argument to a function query. List types take their items from Values,
+// or else from Value split on commas
+type QueryArgument struct {
+	Type   string   `json:"type"`
+	Value  string   `json:"value"`
+	Values []string `json:"values"`
+}
+
+// kdbIdentity is the generic null (::), passed to functions called without arguments
+var kdbIdentity = &kdb.K{Type: kdb.KFUNCUP, Attr: kdb.NONE, Data: byte(0)}
+
+// buildFunctionCall builds the (`fn;arg1;arg2...) list which calls fn with the given arguments when evaluated
+func buildFunctionCall(fn string, args []QueryArgument) (*kdb.K, error) {
+	fn = strings.TrimPrefix(strings.TrimSpace(fn), "`")
+	if fn == "" {
+		return nil, fmt.Errorf("No function given for function query")
+	}
+	call := []*kdb.K{kdb.Symbol(fn)}
+	for i, arg := range args {
+		k, err := arg.toK()
+		if err != nil {
+			return nil, fmt.Errorf("Argument %v to %v: %v", i+1, fn, err)
+		}
+		call = append(call, k)
+	}
+	if len(args) == 0 {
+		call = append(call, kdbIdentity)
+	}
+	return kdb.NewList(call...), nil
+}
+
+// toK converts an argument to a K object of its declared type
+func (a QueryArgument) toK() (*kdb.K, error) {
+	switch a.Type {
+	case argTypeBoolean:
+		b, err := strconv.ParseBool(a.Value)
+		return kdb.Atom(-kdb.KB, b), err
+	case argTypeInt:
+		i, err := strconv.ParseInt(strings.TrimSpace(a.Value), 10, 32)
+		return kdb.Int(int32(i)), err
+	case argTypeLong:
+		j, err := strconv.ParseInt(strings.TrimSpace(a.Value), 10, 64)
+		return kdb.Long(j), err
+	case argTypeFloat:
+		f, err := strconv.ParseFloat(strings.TrimSpace(a.Value), 64)
+		return kdb.Float(f), err
+	case argTypeSymbol:
+		return kdb.Symbol(a.Value), nil
+	case argTypeString:
+		return kdb.Atom(kdb.KC, a.Value), nil
+	case argTypeTimestamp:
+		t, err := parseTimestamp(a.Value)
+		return kdb.Atom(-kdb.KP, t), err
+	case argTypeSymbolList:
+		return kdb.SymbolV(a.items()), nil
+	case argTypeStringList:
+		items := a.items()
+		v := make([]*kdb.K, len(items))
+		for i, item := range items {
+			v[i] = kdb.Atom(kdb.KC, item)
+		}
+		return kdb.NewList(v...), nil
+	case argTypeBooleanList:
+		items := a.items()
+		v := make([]bool, len(items))
+		for i, item := range items {
+			b, err := strconv.ParseBool(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = b
+		}
+		return kdb.Atom(kdb.KB, v), nil
+	case argTypeIntList:
+		items := a.items()
+		v := make([]int32, len(items))
+		for i, item := range items {
+			n, err := strconv.ParseInt(item, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = int32(n)
+		}
+		return kdb.IntV(v), nil
+	case argTypeLongList:
+		items := a.items()
+		v := make([]int64, len(items))
+		for i, item := range items {
+			n, err := strconv.ParseInt(item, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = n
+		}
+		return kdb.LongV(v), nil
+	case argTypeFloatList:
+		items := a.items()
+		v := make([]float64, len(items))
+		for i, item := range items {
+			f, err := strconv.ParseFloat(item, 64)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = f
+		}
+		return kdb.FloatV(v), nil
+	case argTypeTimestampList:
+		items := a.items()
+		v := make([]time.Time, len(items))
+		for i, item := range items {
+			t, err := parseTimestamp(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = t
+		}
+		return kdb.Atom(kdb.KP, v), nil
+	}
+	return nil, fmt.Errorf("Unsupported argument type '%v'", a.Type)
+}
+
+// items returns the items of a list argument
+func (a QueryArgument) items() []string {
+	items := a.Values
+	if items == nil {
+		items = []string{}
+		if strings.TrimSpace(a.Value) != "" {
+			items = strings.Split(a.Value, ",")
+		}
+	}
+	trimmed := make([]string, len(items))
+	for i, item := range items {
+		trimmed[i] = strings.TrimSpace(item)
+	}
+	return trimmed
+}
+
+// parseTimestamp accepts RFC 3339, kdb+ timestamps or milliseconds since the Unix epoch (as Grafana formats ${__from})
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(kdbTimestampFormat, s)
+	if err != nil {
+		return t, fmt.Errorf("Cannot parse '%v' as a timestamp", s)
+	}
+	return t, nil
+}
@@ -12,4 +12,5 @@ func (d *KdbDatasource) setupKdbConnectionHandlers() {
 	d.CloseConnection = d.closeConnection
 	d.WriteConnection = d.writeMessage
 	d.ReadConnection = d.readMessage
+	d.OpenStreamConnection = d.openStreamConnection
 }
@@ -0,0 +1,223 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	kdb "github.com/sv/kdbgo"
+)
+
+// Grafana query types of log queries and of the supplementary log volume query Explore runs alongside them
+const (
+	queryTypeLogs      = "logs"
+	queryTypeLogVolume = "logVolume"
+)
+
+const (
+	defaultLogsMessageColumn = "message"
+	// unknownLogLevel is the level Grafana gives to log lines without one
+	unknownLogLevel = "unknown"
+	// defaultLogVolumeBuckets caps the log volume histogram of a query without max data points
+	defaultLogVolumeBuckets = 1000
+)
+
+// LogsQuery names the columns of a table of log lines to show in Explore
+type LogsQuery struct {
+	MessageColumn string   `json:"messageColumn"`
+	LevelColumn   string   `json:"levelColumn"`
+	LabelColumns  []string `json:"labelColumns"`
+}
+
+// kdbLogRows is a table of log lines reduced to the columns named in a logs query, with labels by label column
+type kdbLogRows struct {
+	times      []time.Time
+	messages   []string
+	levels     []string
+	labelNames []string
+	labels     [][]string
+}
+
+// readLogRows takes the time, message, level and label columns of a table of log lines
+func readLogRows(res *kdb.K, logs *LogsQuery, timeColumn string) (*kdbLogRows, error) {
+	tbl, ok := res.Data.(kdb.Table)
+	if res.Type != kdb.XT || !ok {
+		return nil, fmt.Errorf("Log queries must return an unkeyed table")
+	}
+	if logs == nil {
+		logs = &LogsQuery{}
+	}
+	if timeColumn == "" {
+		timeColumn = defaultTimeColumn
+	}
+	messageColumn := logs.MessageColumn
+	if messageColumn == "" {
+		messageColumn = defaultLogsMessageColumn
+	}
+	cols := map[string]*kdb.K{}
+	for i, name := range tbl.Columns {
+		cols[name] = tbl.Data[i]
+	}
+	column := func(name string) (*kdb.K, error) {
+		col, ok := cols[name]
+		if !ok {
+			return nil, fmt.Errorf("Log table has no column '%v'", name)
+		}
+		return col, nil
+	}
+
+	rows := &kdbLogRows{}
+	col, err := column(timeColumn)
+	if err != nil {
+		return nil, err
+	}
+	if rows.times, err = timeColumnValues(timeColumn, col); err != nil {
+		return nil, err
+	}
+	if col, err = column(messageColumn); err != nil {
+		return nil, err
+	}
+	if rows.messages, err = stringColumnValues(messageColumn, col); err != nil {
+		return nil, err
+	}
+	if logs.LevelColumn != "" {
+		if col, err = column(logs.LevelColumn); err != nil {
+			return nil, err
+		}
+		if rows.levels, err = stringColumnValues(logs.LevelColumn, col); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range logs.LabelColumns {
+		if col, err = column(name); err != nil {
+			return nil, err
+		}
+		strs, err := stringColumnValues(name, col)
+		if err != nil {
+			return nil, err
+		}
+		rows.labelNames = append(rows.labelNames, name)
+		rows.labels = append(rows.labels, strs)
+	}
+	return rows, nil
+}
+
+// level is the log level of a row, or unknown if there is no level column or the level is empty
+func (r *kdbLogRows) level(i int) string {
+	if r.levels == nil || r.levels[i] == "" {
+		return unknownLogLevel
+	}
+	return r.levels[i]
+}
+
+// ParseLogsKdbTable converts a table of log lines to logs frames, one for each distinct set of label values. Each
+// frame has a time field, the message field carrying the frame's labels and, if a level column is named, a level
+// field, which is how Grafana recognises the parts of a log line.
+func ParseLogsKdbTable(res *kdb.K, logs *LogsQuery, timeColumn string) ([]*data.Frame, error) {
+	rows, err := readLogRows(res, logs, timeColumn)
+	if err != nil {
+		return nil, err
+	}
+	type logStream struct {
+		labels data.Labels
+		rows   []int
+	}
+	streams := []*logStream{}
+	byKey := map[string]*logStream{}
+	for i := range rows.times {
+		values := make([]string, len(rows.labels))
+		for j, col := range rows.labels {
+			values[j] = col[i]
+		}
+		key := strings.Join(values, "\x00")
+		s, ok := byKey[key]
+		if !ok {
+			s = &logStream{labels: data.Labels{}}
+			for j, name := range rows.labelNames {
+				s.labels[name] = values[j]
+			}
+			byKey[key] = s
+			streams = append(streams, s)
+		}
+		s.rows = append(s.rows, i)
+	}
+
+	frames := make([]*data.Frame, len(streams))
+	for i, s := range streams {
+		times := make([]time.Time, len(s.rows))
+		messages := make([]string, len(s.rows))
+		levels := make([]string, len(s.rows))
+		for j, row := range s.rows {
+			times[j] = rows.times[row]
+			messages[j] = rows.messages[row]
+			levels[j] = rows.level(row)
+		}
+		frame := data.NewFrame("logs",
+			data.NewField("time", nil, times),
+			data.NewField("message", s.labels, messages))
+		if rows.levels != nil {
+			frame.Fields = append(frame.Fields, data.NewField("level", nil, levels))
+		}
+		frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeLogs}
+		frames[i] = frame
+	}
+	return frames, nil
+}
+
+// logVolumeInterval is the query interval, widened if needed so that the time range is covered in no more buckets
+// than the query's max data points
+func logVolumeInterval(q backend.DataQuery) time.Duration {
+	interval := macroInterval(q)
+	maxBuckets := int64(defaultLogVolumeBuckets)
+	if q.MaxDataPoints > 1 {
+		maxBuckets = q.MaxDataPoints
+	}
+	span := q.TimeRange.To.Sub(q.TimeRange.From)
+	if int64(span/interval) < maxBuckets-1 {
+		return interval
+	}
+	// a bucket may start before the time range, so the range is divided into one fewer than the maximum buckets
+	interval = (span + time.Duration(maxBuckets-2)) / time.Duration(maxBuckets-1)
+	return (interval + time.Millisecond - 1).Truncate(time.Millisecond)
+}
+
+// ParseLogVolumeKdbTable counts the log lines of each level in buckets of the query interval over its time range,
+// giving one series per level for the Explore log volume histogram
+func ParseLogVolumeKdbTable(res *kdb.K, logs *LogsQuery, timeColumn string, q backend.DataQuery) ([]*data.Frame, error) {
+	rows, err := readLogRows(res, logs, timeColumn)
+	if err != nil {
+		return nil, err
+	}
+	interval := logVolumeInterval(q)
+	start := q.TimeRange.From.Truncate(interval)
+	buckets := int(q.TimeRange.To.Sub(start)/interval) + 1
+	levels := []string{}
+	counts := map[string][]int64{}
+	for i, t := range rows.times {
+		if t.Before(q.TimeRange.From) || t.After(q.TimeRange.To) {
+			continue
+		}
+		level := rows.level(i)
+		if _, ok := counts[level]; !ok {
+			counts[level] = make([]int64, buckets)
+			levels = append(levels, level)
+		}
+		counts[level][int(t.Sub(start)/interval)]++
+	}
+
+	times := make([]time.Time, buckets)
+	for i := range times {
+		times[i] = start.Add(time.Duration(i) * interval)
+	}
+	frames := make([]*data.Frame, len(levels))
+	for i, level := range levels {
+		frame := data.NewFrame(level,
+			data.NewField("time", nil, times),
+			data.NewField("count", data.Labels{"level": level}, counts[level]).SetConfig(&data.FieldConfig{DisplayNameFromDS: level}))
+		frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeGraph}
+		frames[i] = frame
+	}
+	return frames, nil
+}
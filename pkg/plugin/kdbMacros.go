@@ -0,0 +1,93 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// defaultMacroInterval is the bucket size used when a query has neither an interval nor max data points
+const defaultMacroInterval = time.Second
+
+var (
+	timeFilterMacro = regexp.MustCompile(`\$__timeFilter\(([^()]*)\)`)
+	timeBucketMacro = regexp.MustCompile(`\$__timeBucket\(([^()]*)\)`)
+	// the variable-like macros must not match the start of a longer name
+	variableMacro = regexp.MustCompile(`\$__(from|to|interval_ms|interval)\b`)
+)
+
+// expandMacros replaces the time range and interval macros in query text with q expressions:
+//
+//	$__timeFilter(col)  (col within <from> <to>)
+//	$__timeBucket(col)  (<interval> xbar col)
+//	$__from, $__to      timestamp literals
+//	$__interval         timespan literal
+//	$__interval_ms      interval in milliseconds as a long
+func expandMacros(text string, q backend.DataQuery) (string, error) {
+	if !strings.Contains(text, "$__") {
+		return text, nil
+	}
+	from := kdbTimestampLiteral(q.TimeRange.From)
+	to := kdbTimestampLiteral(q.TimeRange.To)
+	interval := macroInterval(q)
+
+	var err error
+	expandColumn := func(macro *regexp.Regexp, name string, expand func(col string) string) {
+		text = macro.ReplaceAllStringFunc(text, func(m string) string {
+			col := strings.TrimSpace(macro.FindStringSubmatch(m)[1])
+			if col == "" {
+				err = fmt.Errorf("Macro %v requires a column name", name)
+				return m
+			}
+			return expand(col)
+		})
+	}
+	expandColumn(timeFilterMacro, "$__timeFilter", func(col string) string {
+		return fmt.Sprintf("(%s within %s %s)", col, from, to)
+	})
+	expandColumn(timeBucketMacro, "$__timeBucket", func(col string) string {
+		return fmt.Sprintf("(%s xbar %s)", kdbTimespanLiteral(interval), col)
+	})
+	if err != nil {
+		return "", err
+	}
+	text = variableMacro.ReplaceAllStringFunc(text, func(m string) string {
+		switch m {
+		case "$__from":
+			return from
+		case "$__to":
+			return to
+		case "$__interval_ms":
+			return strconv.FormatInt(interval.Milliseconds(), 10)
+		}
+		return kdbTimespanLiteral(interval)
+	})
+	return text, nil
+}
+
+// macroInterval is the query's interval, or else its time range divided into max data points
+func macroInterval(q backend.DataQuery) time.Duration {
+	if q.Interval > 0 {
+		return q.Interval
+	}
+	if q.MaxDataPoints > 0 {
+		if interval := q.TimeRange.Duration() / time.Duration(q.MaxDataPoints); interval > 0 {
+			return interval
+		}
+	}
+	return defaultMacroInterval
+}
+
+func kdbTimestampLiteral(t time.Time) string {
+	return t.UTC().Format("2006.01.02D15:04:05.000000000")
+}
+
+func kdbTimespanLiteral(d time.Duration) string {
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	return fmt.Sprintf("%dD%02d:%02d:%02d.%09d", days, d/time.Hour, d%time.Hour/time.Minute, d%time.Minute/time.Second, d%time.Second)
+}
@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	kdb "github.com/sv/kdbgo"
+)
+
+// defaultParseTimeout is short so that checking query syntax never holds up the editor or the query it precedes
+const defaultParseTimeout = 2 * time.Second
+
+// parseCheckFunction parses its argument without evaluating it, returning (1b;"") if it parses and (0b;error)
+// otherwise, so that kdb+ errors in parsing are told apart from errors in running the check
+const parseCheckFunction = `{@[{parse x;(1b;"")};x;{(0b;x)}]}`
+
+// ParseQuery is query text to be checked, with the time range (in ms since the Unix epoch) its macros expand to
+type ParseQuery struct {
+	QueryText string `json:"queryText"`
+	From      int64  `json:"from"`
+	To        int64  `json:"to"`
+}
+
+// ParseResult is the outcome of checking query syntax. Position is the offset into the query text of the
+// unbalanced bracket or quote most likely to have caused the error, with its 1-based line and column, if found.
+type ParseResult struct {
+	Valid    bool   `json:"valid"`
+	Error    string `json:"error,omitempty"`
+	Position *int   `json:"position,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+}
+
+// handleParse checks the syntax of query text with kdb+'s parse, without evaluating it
+func (d *KdbDatasource) handleParse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeResourceError(w, http.StatusMethodNotAllowed, fmt.Errorf("Parse requests must be a POST"))
+		return
+	}
+	var pq ParseQuery
+	err := json.NewDecoder(r.Body).Decode(&pq)
+	if err != nil {
+		writeResourceError(w, http.StatusBadRequest, fmt.Errorf("Error decoding parse request: %v", err))
+		return
+	}
+	text, err := expandMacros(pq.QueryText, backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Unix(0, pq.From*int64(time.Millisecond)),
+			To:   time.Unix(0, pq.To*int64(time.Millisecond)),
+		},
+	})
+	if err != nil {
+		writeResourceJSON(w, http.StatusOK, ParseResult{Error: err.Error()})
+		return
+	}
+	pCtx := httpadapter.PluginConfigFromContext(r.Context())
+	ctx, err := d.userContext(r.Context(), pCtx.User)
+	if err != nil {
+		writeResourceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res, err := d.parseQuery(ctx, pCtx, text)
+	if err != nil {
+		writeResourceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeResourceJSON(w, http.StatusOK, res)
+}
+
+// parseQuery sends query text to kdb+ to be parsed under the parse timeout. An error is returned only if the
+// check itself could not be run.
+func (d *KdbDatasource) parseQuery(ctx context.Context, pCtx backend.PluginContext, text string) (*ParseResult, error) {
+	check := kdb.NewList(kdb.NewFunc("", parseCheckFunction), kdb.Atom(kdb.KC, text))
+	res, err := d.RunKdbQuerySync(ctx, buildResourceKdbQuery(d.entryFunction(), pCtx, "PARSE", check, d.parseTimeout), d.parseTimeout)
+	if err != nil {
+		return nil, err
+	}
+	parts, ok := res.Data.([]*kdb.K)
+	if res.Type != kdb.K0 || !ok || len(parts) != 2 || parts[0].Type != -kdb.KB {
+		return nil, fmt.Errorf("Unexpected result checking query syntax")
+	}
+	if parts[0].Data.(bool) {
+		return &ParseResult{Valid: true}, nil
+	}
+	result := &ParseResult{Error: fmt.Sprint(parts[1].Data)}
+	if pos := locateParseError(text); pos >= 0 {
+		result.Position = &pos
+		result.Line = strings.Count(text[:pos], "\n") + 1
+		result.Column = pos - strings.LastIndex(text[:pos], "\n")
+	}
+	return result, nil
+}
+
+// locateParseError returns the offset of the first unmatched closing bracket in q text, or else of the innermost
+// unclosed bracket or string, or -1 if brackets and quotes balance. kdb+ names the offending token in a parse
+// error but not where it is, so this is a best guess for the editor.
+func locateParseError(text string) int {
+	closing := map[byte]byte{')': '(', ']': '[', '}': '{'}
+	open := []int{}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '"':
+			start := i
+			for i++; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(text) {
+				return start
+			}
+		case c == '/' && (i == 0 || strings.IndexByte(" \t\r\n", text[i-1]) >= 0):
+			// a comment runs to the end of the line
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == '(' || c == '[' || c == '{':
+			open = append(open, i)
+		case closing[c] != 0:
+			if len(open) == 0 || text[open[len(open)-1]] != closing[c] {
+				return i
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) > 0 {
+		return open[len(open)-1]
+	}
+	return -1
+}
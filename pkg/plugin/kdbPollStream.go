@@ -0,0 +1,250 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	streamModeTick = "tick"
+	streamModePoll = "poll"
+	// streamPathPoll is the first part of the channel path of polled queries, poll/<hash of the query>
+	streamPathPoll = "poll"
+)
+
+const defaultPollInterval = 5 * time.Second
+
+// registeredStreamTTL is how long a registered query is kept after it was last registered while no stream is
+// running it
+const registeredStreamTTL = time.Hour
+
+// kdbRegisteredStream is a query run by the stream of a Grafana Live channel, either re-evaluated on an interval
+// or run once to backfill a tickerplant subscription. Identical queries share a channel, and Grafana runs one
+// stream per channel, so every subscriber shares one poll loop or subscription.
+type kdbRegisteredStream struct {
+	pCtx       backend.PluginContext
+	refID      string
+	model      json.RawMessage
+	window     time.Duration
+	interval   time.Duration
+	queryIntvl time.Duration
+	maxPoints  int64
+	keyColumn  string
+	timeColumn string
+	// stream is the stream options, including the tickerplant subscription of a backfilled stream
+	stream *StreamQuery
+	// login is the Grafana login of the user the query runs as, who alone may subscribe
+	login string
+	// backfillMark is the earliest watermark of the initial data sent to subscribers before the stream started
+	backfillMark *streamWatermark
+	registered   time.Time
+	running      int
+}
+
+// kdbRegisteredStreams holds the queries registered by stream queries, by channel path
+type kdbRegisteredStreams struct {
+	streams map[string]*kdbRegisteredStream
+	lock    sync.Mutex
+}
+
+// registerPollStream records the query behind a polled stream, returning its channel path
+func (d *KdbDatasource) registerPollStream(pCtx backend.PluginContext, query backend.DataQuery, model QueryModel) (string, error) {
+	s := model.Stream
+	if s.KeyColumn == "" && s.TimeColumn == "" {
+		return "", fmt.Errorf("Polled streams require a key column or time column to find new rows")
+	}
+	interval := defaultPollInterval
+	if s.Interval > 0 {
+		interval = time.Duration(s.Interval) * time.Millisecond
+	}
+	return d.registerStream(streamPathPoll, pCtx, query, model, &kdbRegisteredStream{
+		stream:     s,
+		interval:   interval,
+		keyColumn:  s.KeyColumn,
+		timeColumn: s.TimeColumn,
+	})
+}
+
+// registerStream records the query behind a stream, returning its channel path under kind. The query is run with
+// the stream options removed, over a window of the same length as the query's time range.
+func (d *KdbDatasource) registerStream(kind string, pCtx backend.PluginContext, query backend.DataQuery, model QueryModel, rs *kdbRegisteredStream) (string, error) {
+	model.Stream = nil
+	body, err := json.Marshal(model)
+	if err != nil {
+		return "", err
+	}
+	rs.pCtx = pCtx
+	rs.refID = query.RefID
+	rs.model = body
+	rs.window = query.TimeRange.Duration()
+	rs.queryIntvl = query.Interval
+	rs.maxPoints = query.MaxDataPoints
+	rs.registered = time.Now()
+	// the query runs with the registering user's details, which kdb+ may entitle on, so each user has a channel
+	if pCtx.User != nil {
+		rs.login = pCtx.User.Login
+	}
+	key, _ := json.Marshal([]interface{}{string(body), rs.window, rs.interval, rs.queryIntvl, rs.maxPoints, rs.keyColumn, rs.timeColumn, rs.stream, rs.login})
+	sum := sha256.Sum256(key)
+	path := kind + "/" + hex.EncodeToString(sum[:16])
+
+	d.registeredStreams.lock.Lock()
+	defer d.registeredStreams.lock.Unlock()
+	if d.registeredStreams.streams == nil {
+		d.registeredStreams.streams = make(map[string]*kdbRegisteredStream)
+	}
+	for p, old := range d.registeredStreams.streams {
+		if old.running == 0 && time.Since(old.registered) > registeredStreamTTL {
+			delete(d.registeredStreams.streams, p)
+		}
+	}
+	if old, ok := d.registeredStreams.streams[path]; ok {
+		old.registered = rs.registered
+		return path, nil
+	}
+	d.registeredStreams.streams[path] = rs
+	return path, nil
+}
+
+func (d *KdbDatasource) getRegisteredStream(path string) (*kdbRegisteredStream, error) {
+	d.registeredStreams.lock.Lock()
+	defer d.registeredStreams.lock.Unlock()
+	rs, ok := d.registeredStreams.streams[path]
+	if !ok {
+		return nil, fmt.Errorf("Unknown stream '%v'; rerun the query to register it", path)
+	}
+	return rs, nil
+}
+
+// trackRegisteredStream counts a stream running the registered query, so it is not expired, until the returned
+// func is called
+func (d *KdbDatasource) trackRegisteredStream(rs *kdbRegisteredStream) func() {
+	d.registeredStreams.lock.Lock()
+	rs.running++
+	d.registeredStreams.lock.Unlock()
+	return func() {
+		d.registeredStreams.lock.Lock()
+		rs.running--
+		rs.registered = time.Now()
+		d.registeredStreams.lock.Unlock()
+	}
+}
+
+// dataQuery is the registered query over its window ending at now
+func (rs *kdbRegisteredStream) dataQuery(now time.Time) backend.DataQuery {
+	return backend.DataQuery{
+		RefID:         rs.refID,
+		JSON:          rs.model,
+		TimeRange:     backend.TimeRange{From: now.Add(-rs.window), To: now},
+		Interval:      rs.queryIntvl,
+		MaxDataPoints: rs.maxPoints,
+	}
+}
+
+// runPollStream evaluates the polled query every interval until the last subscriber leaves, pushing the rows of
+// each result which were not in the previous one. Errors from kdb+ are logged and the query retried.
+func (d *KdbDatasource) runPollStream(ctx context.Context, path string, ps *kdbRegisteredStream, sender frameSender) error {
+	ticker := time.NewTicker(ps.interval)
+	defer ticker.Stop()
+	previous := map[string]*data.Frame{}
+	for {
+		res := d.safeQuery(ctx, ps.pCtx, ps.dataQuery(time.Now()))
+		if res.Error != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.DefaultLogger.Error(fmt.Sprintf("Error polling stream %v: %v", path, res.Error))
+		} else {
+			current := map[string]*data.Frame{}
+			for _, frame := range res.Frames {
+				current[frame.Name] = frame
+				rows, err := newFrameRows(previous[frame.Name], frame, ps.keyColumn, ps.timeColumn)
+				if err != nil {
+					log.DefaultLogger.Error(fmt.Sprintf("Error finding new rows of stream %v: %v", path, err))
+					continue
+				}
+				if rows.Rows() == 0 {
+					continue
+				}
+				// a polled query may return several frames, so each is sent with its schema
+				err = sender.SendFrame(rows, data.IncludeAll)
+				if err != nil {
+					return err
+				}
+			}
+			previous = current
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// newFrameRows returns the rows of a polled result which are new since the previous result: those whose key is
+// not among the previous keys, or whose time (or sequence number) is after the latest previous one. All rows are new on the first poll.
+func newFrameRows(previous *data.Frame, current *data.Frame, keyColumn string, timeColumn string) (*data.Frame, error) {
+	if previous == nil {
+		return current, nil
+	}
+	column := keyColumn
+	if column == "" {
+		column = timeColumn
+	}
+	prevIdx := fieldIndex(previous, column)
+	idx := fieldIndex(current, column)
+	if prevIdx < 0 || idx < 0 {
+		return nil, fmt.Errorf("Stream result has no column '%v'", column)
+	}
+	if keyColumn == "" {
+		mark := &streamWatermark{column: timeColumn}
+		if err := mark.advance(previous); err != nil {
+			return nil, err
+		}
+		return mark.newRows(current)
+	}
+	prevField := previous.Fields[prevIdx]
+	field := current.Fields[idx]
+	seen := make(map[string]bool, prevField.Len())
+	for i := 0; i < prevField.Len(); i++ {
+		seen[fmt.Sprint(prevField.At(i))] = true
+	}
+	return filterFrameRows(current, func(i int) bool { return !seen[fmt.Sprint(field.At(i))] }), nil
+}
+
+// filterFrameRows copies the rows of a frame for which keep is true
+func filterFrameRows(frame *data.Frame, keep func(i int) bool) *data.Frame {
+	filtered := data.NewFrame(frame.Name)
+	for _, f := range frame.Fields {
+		field := data.NewFieldFromFieldType(f.Type(), 0)
+		field.Name = f.Name
+		field.Labels = f.Labels
+		filtered.Fields = append(filtered.Fields, field)
+	}
+	rows, _ := frame.RowLen()
+	for i := 0; i < rows; i++ {
+		if keep(i) {
+			filtered.AppendRow(frame.RowCopy(i)...)
+		}
+	}
+	return filtered
+}
+
+func fieldIndex(frame *data.Frame, name string) int {
+	for i, field := range frame.Fields {
+		if field.Name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	defaultPoolMinSize     = 1
+	defaultPoolMaxSize     = 5
+	defaultPoolIdleTimeout = 5 * time.Minute
+)
+
+// kdbHandle is a single IPC connection within a kdbPool. Each handle is owned by exactly
+// one syncQueryRunner goroutine, so only one synchronous query is ever outstanding on it.
+// In async mode many queries may be in flight at once, tracked by correlation id in pending.
+type kdbHandle struct {
+	id          uint32
+	pool        *kdbPool
+	conn        kdbConn
+	open        int32
+	rawReadChan chan *kdbRawRead
+	listenerEnd chan struct{}
+	pending     map[uint32]*kdbSyncQuery
+	pendingLock sync.Mutex
+	lastUsed    time.Time
+}
+
+// IsOpen reports whether the handle's connection is open. Both the query runner and the handle listener
+// change this, so it is only accessed atomically.
+func (h *kdbHandle) IsOpen() bool {
+	return atomic.LoadInt32(&h.open) == 1
+}
+
+func (h *kdbHandle) setOpen() {
+	atomic.StoreInt32(&h.open, 1)
+}
+
+// markClosed marks the handle closed, reporting whether it was open so that only one goroutine acts on the close
+func (h *kdbHandle) markClosed() bool {
+	return atomic.CompareAndSwapInt32(&h.open, 1, 0)
+}
+
+// awaitListener waits for the handle's listener to return once its connection is closed, so that it cannot
+// act on a connection opened in its place
+func (h *kdbHandle) awaitListener(timeout time.Duration) {
+	if h.listenerEnd == nil {
+		return
+	}
+	select {
+	case <-h.listenerEnd:
+	case <-time.After(timeout):
+		log.DefaultLogger.Error(fmt.Sprintf("Listener for handle %v did not return after its connection closed", h.id))
+	}
+	h.listenerEnd = nil
+}
+
+// kdbPool holds the shared query queue and the bookkeeping for the handles serving it.
+// Handles are added on demand up to maxSize and closed again after idleTimeout, but the
+// pool never shrinks below minSize. Pools for passed-through users authenticate as that user.
+type kdbPool struct {
+	endpoint      *kdbEndpoint
+	breaker       *kdbBreaker
+	user          string
+	syncQueue     chan *kdbSyncQuery
+	minSize       int
+	maxSize       int
+	idleTimeout   time.Duration
+	size          int
+	handleCounter uint32
+	lock          sync.Mutex
+}
+
+func newKdbPool(minSize int, maxSize int, idleTimeout time.Duration) *kdbPool {
+	if minSize < 1 {
+		minSize = defaultPoolMinSize
+	}
+	if maxSize < 1 {
+		maxSize = defaultPoolMaxSize
+	}
+	if maxSize < minSize {
+		log.DefaultLogger.Info(fmt.Sprintf("Pool max size %v is below min size %v; using %v", maxSize, minSize, minSize))
+		maxSize = minSize
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultPoolIdleTimeout
+	}
+	return &kdbPool{
+		syncQueue:   make(chan *kdbSyncQuery),
+		minSize:     minSize,
+		maxSize:     maxSize,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// reserve returns a new (unopened) handle if the pool has not reached its maximum size
+func (p *kdbPool) reserve() (*kdbHandle, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.size >= p.maxSize {
+		return nil, false
+	}
+	p.size += 1
+	return &kdbHandle{id: atomic.AddUint32(&p.handleCounter, 1), pool: p, lastUsed: time.Now()}, true
+}
+
+// release gives up an idle handle's slot, unless doing so would shrink the pool below minSize
+func (p *kdbPool) release() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.size <= p.minSize {
+		return false
+	}
+	p.size -= 1
+	return true
+}
+
+func (p *kdbPool) Size() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.size
+}
+
+// growPool starts a new handle and query runner if the pool has capacity for one
+func (d *KdbDatasource) growPool(p *kdbPool) bool {
+	h, ok := p.reserve()
+	if !ok {
+		return false
+	}
+	log.DefaultLogger.Debug(fmt.Sprintf("Adding handle %v to pool for %v (size %v/%v)", h.id, p.endpoint, p.Size(), p.maxSize))
+	go d.syncQueryRunner(h)
+	return true
+}
@@ -1,8 +1,10 @@
 package plugin
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -12,110 +14,285 @@ import (
 
 const kdbEOF = "Failed to read message header:"
 
-// wrappers for correct run-time evaluation of KdbHandle pointer and to enable unit testing
-func (d *KdbDatasource) writeMessage(msgtype kdb.ReqType, obj *kdb.K) error {
-	return d.KdbHandle.WriteMessage(msgtype, obj)
+// defaultEntryFunction evaluates the query text in the QUERYDATA dict; configuring a named entry
+// function instead means kdb+ processes need only allow that one function to be called
+const defaultEntryFunction = "{[x] value x[`Query;`Query]}"
+
+// entryFunction returns the function each QUERYDATA dict is passed to
+func (d *KdbDatasource) entryFunction() *kdb.K {
+	if d.EntryFunction == "" {
+		return kdb.Atom(kdb.KC, defaultEntryFunction)
+	}
+	return kdb.Symbol(d.EntryFunction)
+}
+
+// healthCheckFunction returns the function health checks are passed to, which is the entry function unless
+// a separate one is configured
+func (d *KdbDatasource) healthCheckFunction() *kdb.K {
+	if d.HealthCheckFunction == "" {
+		return d.entryFunction()
+	}
+	return kdb.Symbol(d.HealthCheckFunction)
+}
+
+// wrappers for correct run-time evaluation of handle pointers and to enable unit testing
+func (d *KdbDatasource) writeMessage(h *kdbHandle, msgtype kdb.ReqType, obj *kdb.K) error {
+	return h.conn.WriteMessage(msgtype, obj)
 }
 
-func (d *KdbDatasource) readMessage() (*kdb.K, kdb.ReqType, error) {
-	return d.KdbHandle.ReadMessage()
+func (d *KdbDatasource) readMessage(h *kdbHandle) (*kdb.K, kdb.ReqType, error) {
+	return h.conn.ReadMessage()
 }
 
-// support maximum queue of 100 000 per handle
+// support maximum queue of 100 000 per datasource
 func (d *KdbDatasource) getKdbSyncQueryId() uint32 {
-	if d.kdbSyncQueryCounter > 100000 {
-		d.kdbSyncQueryCounter = 0
-	}
-	d.kdbSyncQueryCounter += 1
-	return d.kdbSyncQueryCounter
+	return atomic.AddUint32(&d.kdbSyncQueryCounter, 1) % 100000
 }
 
-func (d *KdbDatasource) runKdbQuerySync(query *kdb.K, timeout time.Duration) (*kdb.K, error) {
+// runKdbQueryOnEndpoint queues a query for the next free handle in an endpoint's pool (or the user's pool
+// for that endpoint when passing users through) and waits for its result
+func (d *KdbDatasource) runKdbQueryOnEndpoint(ctx context.Context, e *kdbEndpoint, query *kdb.K, timeout time.Duration) (*kdb.K, error) {
+	p := d.poolFor(ctx, e)
+	// fail fast rather than queueing behind handles which cannot connect
+	if wait, open := p.breaker.isOpen(); open {
+		return nil, &kdbConnectionError{endpoint: e, err: kdbUnavailableError(wait)}
+	}
 	id := d.getKdbSyncQueryId()
-	queryObj := &kdbSyncQuery{query: query, id: id, timeout: timeout}
-	d.syncQueue <- queryObj
-	for {
-		res := <-d.syncResChan
-		if res.id != queryObj.id {
-			continue
+	queryObj := &kdbSyncQuery{ctx: ctx, query: query, id: id, timeout: timeout, resChan: make(chan *kdbSyncRes, 1)}
+	select {
+	case p.syncQueue <- queryObj:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		// No handle is free; add one to the pool if possible, otherwise wait for the next free handle
+		d.growPool(p)
+		select {
+		case p.syncQueue <- queryObj:
+		case <-ctx.Done():
+			log.DefaultLogger.Debug(fmt.Sprintf("Query %v cancelled before being sent, removed from queue", id))
+			return nil, ctx.Err()
+		case <-d.signals:
+			return nil, fmt.Errorf("Datasource disposed before query could be run")
 		}
+	}
+	select {
+	case res := <-queryObj.resChan:
 		return res.result, res.err
+	case <-ctx.Done():
+		// the query runner abandons the in-flight query and recycles its handle
+		return nil, ctx.Err()
 	}
 }
 
-func (d *KdbDatasource) syncQueryRunner() {
-	log.DefaultLogger.Debug("Beginning synchronous query listener")
+// abandonQuery discards the reply to a cancelled query so that the handle can be safely reused.
+// If the reply does not arrive before the query's timeout the handle is closed instead.
+func (d *KdbDatasource) abandonQuery(h *kdbHandle, query *kdbSyncQuery, sent time.Time) {
+	log.DefaultLogger.Debug(fmt.Sprintf("Query %v cancelled while in flight, discarding its reply on handle %v", query.id, h.id))
+	select {
+	case msg := <-h.rawReadChan:
+		if msg.err != nil && strings.Contains(msg.err.Error(), kdbEOF) {
+			d.CloseConnection(h)
+		}
+	case <-time.After(query.timeout - time.Since(sent)):
+		log.DefaultLogger.Debug(fmt.Sprintf("No reply to cancelled query %v within its timeout, closing handle %v", query.id, h.id))
+		d.CloseConnection(h)
+	}
+}
+
+func (d *KdbDatasource) syncQueryRunner(h *kdbHandle) {
+	log.DefaultLogger.Debug(fmt.Sprintf("Beginning synchronous query listener for handle %v", h.id))
 	var err error
 	// Open the kdb Handle
-	err = d.OpenConnection()
+	err = d.openHandle(h)
 	if err != nil {
-		log.DefaultLogger.Error(fmt.Sprintf("Error opening handle to kdb+ process when creating datasource: %v", err))
+		log.DefaultLogger.Error(fmt.Sprintf("Error opening handle %v to kdb+ process: %v", h.id, err))
 	}
 	for {
+		// heartbeats are only sent after the handle has been idle for a full interval
+		var heartbeat <-chan time.Time
+		if d.heartbeatInterval > 0 {
+			heartbeat = time.After(d.heartbeatInterval)
+		}
 		select {
-		case signal := <-d.signals:
-			if signal == 3 {
-				log.DefaultLogger.Debug("Returning from query runner")
+		case signal, ok := <-d.signals:
+			if !ok || signal == 3 {
+				log.DefaultLogger.Debug(fmt.Sprintf("Returning from query runner for handle %v", h.id))
+				d.CloseConnection(h)
 				return
 			}
-		case query := <-d.syncQueue:
-			// If handle isn't open, attempt to open
-			if !d.IsOpen {
-				log.DefaultLogger.Debug("Handle not open, opening new handle...")
-				err = d.OpenConnection()
-				// Return error if unable to open handle
-				if err != nil {
-					log.DefaultLogger.Error(fmt.Sprintf("Unable to open handle on-demand in syncQueryRunner: %v", err))
-					d.syncResChan <- &kdbSyncRes{result: nil, err: err, id: query.id}
-					continue
+		case <-time.After(h.pool.idleTimeout - time.Since(h.lastUsed)):
+			if h.pool.release() {
+				log.DefaultLogger.Debug(fmt.Sprintf("Handle %v idle for %v, removing from pool", h.id, h.pool.idleTimeout))
+				d.CloseConnection(h)
+				if h.pool.user != "" {
+					h.pool.endpoint.evictUserPool(h.pool)
 				}
+				return
 			}
-			// If handle is open, query the kdb+ process
-			err = d.WriteConnection(kdb.SYNC, query.query)
-			if err != nil {
-				log.DefaultLogger.Error("Error writing message", err.Error())
-				d.syncResChan <- &kdbSyncRes{result: nil, err: err, id: query.id}
-				continue
+			h.lastUsed = time.Now()
+		case <-heartbeat:
+			d.heartbeat(h)
+		case query := <-h.pool.syncQueue:
+			d.runSyncQuery(h, query)
+			h.lastUsed = time.Now()
+		}
+	}
+}
+
+// runSyncQuery sends a query on a handle owned by the calling query runner and waits for its reply
+func (d *KdbDatasource) runSyncQuery(h *kdbHandle, query *kdbSyncQuery) {
+	var err error
+	// Skip queries cancelled while waiting in the queue
+	if query.ctx.Err() != nil {
+		log.DefaultLogger.Debug(fmt.Sprintf("Query %v cancelled before being sent, skipping", query.id))
+		return
+	}
+	// If handle isn't open, attempt to open
+	if !h.IsOpen() {
+		log.DefaultLogger.Debug("Handle not open, opening new handle...")
+		// release the socket and listener of a connection dropped by kdb+ before replacing it
+		d.CloseConnection(h)
+		err = d.openHandle(h)
+		// Return error if unable to open handle
+		if err != nil {
+			log.DefaultLogger.Error(fmt.Sprintf("Unable to open handle on-demand in syncQueryRunner: %v", err))
+			if _, ok := err.(*kdbUserRejectedError); ok {
+				query.resChan <- &kdbSyncRes{result: nil, err: err, id: query.id}
+				return
 			}
+			query.resChan <- &kdbSyncRes{result: nil, err: &kdbConnectionError{endpoint: h.pool.endpoint, err: err}, id: query.id}
+			return
+		}
+	}
+	// In async mode the reply is routed to the query by kdbHandleListener
+	if d.AsyncQueries {
+		d.runKdbQueryAsync(h, query)
+		return
+	}
+	// If handle is open, query the kdb+ process
+	err = d.WriteConnection(h, kdb.SYNC, query.query)
+	if err != nil {
+		log.DefaultLogger.Error("Error writing message", err.Error())
+		query.resChan <- &kdbSyncRes{result: nil, err: err, id: query.id}
+		return
+	}
+	sent := time.Now()
 
-			select {
-			case msg := <-d.rawReadChan:
-				d.syncResChan <- &kdbSyncRes{result: msg.result, err: msg.err, id: query.id}
-				if msg.err != nil && strings.Contains(msg.err.Error(), kdbEOF) {
-					log.DefaultLogger.Debug("Closing rawReadChan within syncQueryRunner")
-					d.CloseConnection()
-				}
-			case <-time.After(query.timeout):
-				d.syncResChan <- &kdbSyncRes{result: nil, err: fmt.Errorf("Queried timed out after %v", query.timeout), id: query.id}
-				d.CloseConnection()
+	select {
+	case msg := <-h.rawReadChan:
+		query.resChan <- &kdbSyncRes{result: msg.result, err: msg.err, id: query.id}
+		if msg.err != nil && strings.Contains(msg.err.Error(), kdbEOF) {
+			log.DefaultLogger.Debug("Closing rawReadChan within syncQueryRunner")
+			d.CloseConnection(h)
+			d.ejectEndpoint(h.pool.endpoint)
+		}
+	case <-time.After(query.timeout):
+		query.resChan <- &kdbSyncRes{result: nil, err: fmt.Errorf("Queried timed out after %v", query.timeout), id: query.id}
+		d.CloseConnection(h)
+	case <-query.ctx.Done():
+		query.resChan <- &kdbSyncRes{result: nil, err: query.ctx.Err(), id: query.id}
+		d.abandonQuery(h, query, sent)
+	}
+}
+
+// heartbeat pings an idle handle, closing it and reconnecting if kdb+ does not reply in time so that
+// dead connections are replaced before a user query is sent on them
+func (d *KdbDatasource) heartbeat(h *kdbHandle) {
+	if !h.IsOpen() {
+		log.DefaultLogger.Debug(fmt.Sprintf("Heartbeat reconnecting closed handle %v", h.id))
+		d.CloseConnection(h)
+		d.openHandle(h)
+		return
+	}
+	// a sync ping would wait behind in-flight async queries, so skip it while any are outstanding
+	h.pendingLock.Lock()
+	inFlight := len(h.pending)
+	h.pendingLock.Unlock()
+	if inFlight > 0 {
+		return
+	}
+	err := d.WriteConnection(h, kdb.SYNC, kdb.Atom(kdb.KC, "::"))
+	if err == nil {
+		select {
+		case msg := <-h.rawReadChan:
+			// any reply, including a kdb+ error, shows the handle is alive
+			if msg.err == nil || !strings.Contains(msg.err.Error(), kdbEOF) {
+				return
 			}
+			err = msg.err
+		case <-time.After(d.DialTimeout):
+			err = fmt.Errorf("no reply within %v", d.DialTimeout)
 		}
 	}
+	log.DefaultLogger.Info(fmt.Sprintf("Heartbeat failed on handle %v to %v (%v), reconnecting", h.id, h.pool.endpoint, err))
+	d.CloseConnection(h)
+	err = d.openHandle(h)
+	if err != nil {
+		log.DefaultLogger.Error(fmt.Sprintf("Error reconnecting handle %v after failed heartbeat: %v", h.id, err))
+	}
 }
 
-func (d *KdbDatasource) kdbHandleListener() {
+func (d *KdbDatasource) kdbHandleListener(h *kdbHandle) {
 	for {
-		if !d.IsOpen {
+		if !h.IsOpen() {
 			log.DefaultLogger.Debug("Handle not open, kdbHandleListener returning...")
 			return
 		}
-		res, _, err := d.ReadConnection()
+		res, msgtype, err := d.ReadConnection(h)
+		if err == nil && msgtype == kdb.ASYNC {
+			d.routeAsyncReply(h, res)
+			continue
+		}
 		if err != nil {
 			log.DefaultLogger.Debug(err.Error())
 			if strings.Contains(err.Error(), kdbEOF) {
 				log.DefaultLogger.Debug("Handle read error, publishing error and returning from kdbHandleListener")
-				if d.IsOpen {
-					log.DefaultLogger.Debug("d.IsOpen inside kdbHandleListener, publishing read error to kdbRawRead channel")
-					d.IsOpen = false
-					d.rawReadChan <- &kdbRawRead{result: res, err: err}
+				if d.AsyncQueries {
+					// nothing waits on rawReadChan in async mode, so fail the in-flight queries directly
+					h.markClosed()
+					h.failPending(err)
+					return
+				}
+				if h.markClosed() {
+					log.DefaultLogger.Debug("Handle open inside kdbHandleListener, publishing read error to kdbRawRead channel")
+					h.rawReadChan <- &kdbRawRead{result: res, err: err}
 				}
 				return
 			}
 		}
-		d.rawReadChan <- &kdbRawRead{result: res, err: err}
+		h.rawReadChan <- &kdbRawRead{result: res, err: err}
 	}
 }
 
+func buildHealthCheckKdbQuery(fn *kdb.K, pCtx backend.PluginContext, timeout time.Duration) *kdb.K {
+	userDict := buildUserKdbDict(pCtx.User)
+	datasourceDict := buildDatasourceKdbDict(pCtx.DataSourceInstanceSettings)
+	k := kdb.SymbolV([]string{"AQUAQ_KDB_BACKEND_GRAF_DATASOURCE", "Time", "OrgID", "Datasource", "User", "Query", "Timeout"})
+	v := kdb.NewList(
+		kdb.Float(ADAPTOR_VERSION),
+		kdb.Atom(-kdb.KP, time.Now()),
+		kdb.Long(pCtx.OrgID),
+		datasourceDict,
+		userDict,
+		kdb.NewDict(kdb.SymbolV([]string{"Query", "QueryType"}), kdb.NewList(kdb.Atom(kdb.KC, "1+1"), kdb.Symbol("HEALTHCHECK"))),
+		kdb.Long(int64(timeout)))
+	return kdb.NewList(fn, kdb.NewDict(k, v))
+}
+
+// buildResourceKdbQuery wraps a query run on behalf of a resource endpoint in the same dict as other queries
+func buildResourceKdbQuery(fn *kdb.K, pCtx backend.PluginContext, queryType string, query *kdb.K, timeout time.Duration) *kdb.K {
+	k := kdb.SymbolV([]string{"AQUAQ_KDB_BACKEND_GRAF_DATASOURCE", "Time", "OrgID", "Datasource", "User", "Query", "Timeout"})
+	v := kdb.NewList(
+		kdb.Float(ADAPTOR_VERSION),
+		kdb.Atom(-kdb.KP, time.Now()),
+		kdb.Long(pCtx.OrgID),
+		buildDatasourceKdbDict(pCtx.DataSourceInstanceSettings),
+		buildUserKdbDict(pCtx.User),
+		kdb.NewDict(kdb.SymbolV([]string{"Query", "QueryType"}), kdb.NewList(query, kdb.Symbol(queryType))),
+		kdb.Long(timeout.Milliseconds()))
+	return kdb.NewList(fn, kdb.NewDict(k, v))
+}
+
 func buildDatasourceKdbDict(settings *backend.DataSourceInstanceSettings) *kdb.K {
 	datasourceKeys := kdb.SymbolV([]string{"ID", "Name", "UID", "URL", "Updated", "User"})
 	var datasourceValues *kdb.K
@@ -158,14 +335,17 @@ func buildUserKdbDict(settings *backend.User) *kdb.K {
 	return kdb.NewDict(userKeys, userValues)
 }
 
-func buildQueryKdbDict(q backend.DataQuery, qText string) *kdb.K {
-	queryKeys := kdb.SymbolV([]string{"RefID", "Query", "QueryType", "MaxDataPoints", "Interval", "TimeRange"})
+// buildQueryKdbDict builds the query info dict; query is the query text, or for function queries the call to evaluate
+func buildQueryKdbDict(q backend.DataQuery, query *kdb.K, queryType string, variables *kdb.K, filters *kdb.K) *kdb.K {
+	queryKeys := kdb.SymbolV([]string{"RefID", "Query", "QueryType", "MaxDataPoints", "Interval", "TimeRange", "Variables", "Filters"})
 	queryValues := kdb.NewList(
 		kdb.Atom(kdb.KC, q.RefID),
-		kdb.Atom(kdb.KC, qText),
-		kdb.Symbol("QUERY"),
+		query,
+		kdb.Symbol(queryType),
 		kdb.Long(q.MaxDataPoints),
 		kdb.Long(int64(q.Interval)),
-		kdb.Atom(kdb.KP, []time.Time{q.TimeRange.From, q.TimeRange.To}))
+		kdb.Atom(kdb.KP, []time.Time{q.TimeRange.From, q.TimeRange.To}),
+		variables,
+		filters)
 	return kdb.NewDict(queryKeys, queryValues)
 }
@@ -0,0 +1,211 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	kdb "github.com/sv/kdbgo"
+)
+
+const queryModeBuilder = "builder"
+
+// BuilderQuery is a query built in the visual query builder, compiled to a functional select rather than q text
+type BuilderQuery struct {
+	Table      string          `json:"table"`
+	Columns    []BuilderColumn `json:"columns"`
+	Where      []BuilderFilter `json:"where"`
+	By         []string        `json:"by"`
+	TimeColumn string          `json:"timeColumn"`
+	TimeBucket bool            `json:"timeBucket"`
+}
+
+// BuilderColumn is a selected column, optionally aggregated
+type BuilderColumn struct {
+	Name        string `json:"name"`
+	Aggregation string `json:"aggregation"`
+	Alias       string `json:"alias"`
+}
+
+// BuilderFilter is a where condition comparing a column to a typed value
+type BuilderFilter struct {
+	Column   string        `json:"column"`
+	Operator string        `json:"operator"`
+	Value    QueryArgument `json:"value"`
+}
+
+// aggregations are referred to by their .q names, so that the parse tree does not depend on how kdb+
+// resolves unqualified keywords
+var builderAggregations = map[string]string{
+	"avg":   ".q.avg",
+	"sum":   ".q.sum",
+	"min":   ".q.min",
+	"max":   ".q.max",
+	"first": ".q.first",
+	"last":  ".q.last",
+	"count": ".q.count",
+	"dev":   ".q.dev",
+	"med":   ".q.med",
+}
+
+// kdbDyad is a dyadic primitive, identified in IPC by its index in ":+-*%&|^=<>$,#_~!?@."
+func kdbDyad(op byte) *kdb.K {
+	return &kdb.K{Type: kdb.KFUNCBP, Attr: kdb.NONE, Data: byte(strings.IndexByte(":+-*%&|^=<>$,#_~!?@.", op))}
+}
+
+// compileBuilderQuery compiles a builder query into a single functional select ?[t;c;b;a], which the entry function
+// evaluates with value. The where clause is restricted to the query's time range on the time column, and if time
+// bucketing is enabled rows are grouped into buckets of the query interval. Grouping by the by-columns as well
+// computes each group's buckets within the select, giving a list of values per group and so one series per group.
+func compileBuilderQuery(b *BuilderQuery, q backend.DataQuery) (*kdb.K, error) {
+	if b == nil || strings.TrimSpace(b.Table) == "" {
+		return nil, fmt.Errorf("No table selected in query builder")
+	}
+	if b.TimeBucket && b.TimeColumn == "" {
+		return nil, fmt.Errorf("Time bucketing requires a time column")
+	}
+
+	// c: where clauses
+	where := []*kdb.K{}
+	if b.TimeColumn != "" {
+		where = append(where, kdb.NewList(kdb.Symbol(".q.within"), kdb.Symbol(b.TimeColumn), kdb.Atom(kdb.KP, []time.Time{q.TimeRange.From, q.TimeRange.To})))
+	}
+	for _, f := range b.Where {
+		clause, err := compileBuilderFilter(f)
+		if err != nil {
+			return nil, err
+		}
+		where = append(where, clause)
+	}
+
+	// the time bucket each row falls in; kdbgo cannot encode timespan atoms, so the bucket size is taken as the
+	// first of a timespan list
+	var bucket *kdb.K
+	if b.TimeBucket {
+		interval := kdb.NewList(kdb.Symbol(".q.first"), kdb.Atom(kdb.KN, []time.Duration{macroInterval(q)}))
+		bucket = kdb.NewList(kdb.Symbol(".q.xbar"), interval, kdb.Symbol(b.TimeColumn))
+	}
+	// when grouping buckets within each by-group, a column is indexed by the rows of each bucket in time order
+	regroup := b.TimeBucket && len(b.By) > 0
+	var bucketRows *kdb.K
+	if regroup {
+		groups := kdb.NewList(kdb.Symbol(".q.group"), bucket)
+		bucketRows = kdb.NewList(kdbDyad('@'), groups, kdb.NewList(kdb.Symbol(".q.asc"), kdb.NewList(kdb.Symbol(".q.key"), groups)))
+	}
+
+	// a: selected columns, or all columns if none are selected
+	aggNames := []string{}
+	aggValues := []*kdb.K{}
+	if regroup {
+		aggNames = append(aggNames, b.TimeColumn)
+		aggValues = append(aggValues, kdb.NewList(kdb.Symbol(".q.asc"), kdb.NewList(kdb.Symbol(".q.distinct"), bucket)))
+	}
+	for _, c := range b.Columns {
+		if c.Name == "" {
+			return nil, fmt.Errorf("Selected column has no name")
+		}
+		name := c.Alias
+		if name == "" {
+			name = c.Name
+		}
+		aggNames = append(aggNames, name)
+		var col *kdb.K = kdb.Symbol(c.Name)
+		if regroup {
+			col = kdb.NewList(kdbDyad('@'), col, bucketRows)
+		}
+		if c.Aggregation == "" {
+			aggValues = append(aggValues, col)
+			continue
+		}
+		fn, ok := builderAggregations[c.Aggregation]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported aggregation '%v'", c.Aggregation)
+		}
+		if regroup {
+			aggValues = append(aggValues, kdb.NewList(kdb.Symbol(".q.each"), kdb.Symbol(fn), col))
+		} else {
+			aggValues = append(aggValues, kdb.NewList(kdb.Symbol(fn), col))
+		}
+	}
+	var aggs *kdb.K
+	if len(aggNames) == 0 {
+		aggs = kdb.NewList()
+	} else {
+		aggs = kdb.NewDict(kdb.SymbolV(aggNames), kdb.NewList(aggValues...))
+	}
+
+	// b: the time bucket and by-columns, or no grouping (0b)
+	byNames := []string{}
+	byValues := []*kdb.K{}
+	if b.TimeBucket && !regroup {
+		byNames = append(byNames, b.TimeColumn)
+		byValues = append(byValues, bucket)
+	}
+	for _, col := range b.By {
+		byNames = append(byNames, col)
+		byValues = append(byValues, kdb.Symbol(col))
+	}
+	var by *kdb.K
+	if len(byNames) == 0 {
+		by = kdb.Atom(-kdb.KB, false)
+	} else {
+		by = kdb.NewDict(kdb.SymbolV(byNames), kdb.NewList(byValues...))
+	}
+
+	return kdb.NewList(kdbDyad('?'), kdb.Symbol(b.Table), kdb.NewList(where...), by, aggs), nil
+}
+
+// unkeysResult reports whether the keyed table a builder query returns should be unkeyed, as when grouping by
+// either the time bucket or the by-columns alone
+func (b *BuilderQuery) unkeysResult() bool {
+	return b.TimeBucket != (len(b.By) > 0)
+}
+
+// unkeyKdbTable joins the key and value columns of a keyed table, as 0! would in kdb+
+func unkeyKdbTable(res *kdb.K) *kdb.K {
+	if res.Type != kdb.XD {
+		return res
+	}
+	dict := res.Data.(kdb.Dict)
+	if dict.Key.Type != kdb.XT || dict.Value.Type != kdb.XT {
+		return res
+	}
+	keys := dict.Key.Data.(kdb.Table)
+	values := dict.Value.Data.(kdb.Table)
+	cols := append(append([]string{}, keys.Columns...), values.Columns...)
+	data := append(append([]*kdb.K{}, keys.Data...), values.Data...)
+	return kdb.NewTable(cols, data)
+}
+
+// compileBuilderFilter compiles a where condition to a parse tree; constants are enlisted where kdb+ would
+// otherwise evaluate them as column names or parse trees
+func compileBuilderFilter(f BuilderFilter) (*kdb.K, error) {
+	if f.Column == "" {
+		return nil, fmt.Errorf("Where condition has no column")
+	}
+	value, err := f.Value.toK()
+	if err != nil {
+		return nil, fmt.Errorf("Where condition on %v: %v", f.Column, err)
+	}
+	switch {
+	case value.Type == -kdb.KS:
+		value = kdb.SymbolV([]string{value.Data.(string)})
+	case value.Type == kdb.KS || value.Type == kdb.K0:
+		value = kdb.NewList(value)
+	}
+	col := kdb.Symbol(f.Column)
+	switch f.Operator {
+	case "=", "<", ">":
+		return kdb.NewList(kdbDyad(f.Operator[0]), col, value), nil
+	case "<>":
+		return kdb.NewList(kdb.Symbol(".q.not"), kdb.NewList(kdbDyad('='), col, value)), nil
+	case "<=":
+		return kdb.NewList(kdb.Symbol(".q.not"), kdb.NewList(kdbDyad('>'), col, value)), nil
+	case ">=":
+		return kdb.NewList(kdb.Symbol(".q.not"), kdb.NewList(kdbDyad('<'), col, value)), nil
+	case "in", "within", "like":
+		return kdb.NewList(kdb.Symbol(".q."+f.Operator), col, value), nil
+	}
+	return nil, fmt.Errorf("Unsupported operator '%v'", f.Operator)
+}
@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	kdb "github.com/sv/kdbgo"
+)
+
+// defaultResourceTimeout is the timeout for queries run on behalf of resource endpoints, matching the default query timeout
+const defaultResourceTimeout = 10 * time.Second
+
+// setupResourceHandlers registers the datasource's resource endpoints
+func (d *KdbDatasource) setupResourceHandlers() {
+	log.DefaultLogger.Debug("Setting resource handlers...")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tag-keys", d.handleTagKeys)
+	mux.HandleFunc("/tag-values", d.handleTagValues)
+	mux.HandleFunc("/variable-query", d.handleVariableQuery)
+	mux.HandleFunc("/parse", d.handleParse)
+	d.schemaCache = newKdbSchemaCache(d.schemaCacheTTL)
+	d.registerSchemaRoutes(mux)
+	d.resourceHandler = httpadapter.New(mux)
+}
+
+func (d *KdbDatasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	return d.resourceHandler.CallResource(ctx, req, sender)
+}
+
+// runResourceQuery sends a query of the given type to kdb+ as the user calling the resource
+func (d *KdbDatasource) runResourceQuery(r *http.Request, queryType string, query *kdb.K) (*kdb.K, error) {
+	pCtx := httpadapter.PluginConfigFromContext(r.Context())
+	ctx, err := d.userContext(r.Context(), pCtx.User)
+	if err != nil {
+		return nil, err
+	}
+	return d.RunKdbQuerySync(ctx, buildResourceKdbQuery(d.entryFunction(), pCtx, queryType, query, defaultResourceTimeout), defaultResourceTimeout)
+}
+
+// writeResourceJSON writes v as the JSON response to a resource call
+func writeResourceJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.DefaultLogger.Error(fmt.Sprintf("Error encoding resource response: %v", err))
+		status = http.StatusInternalServerError
+		body = []byte(`{"error":"Error encoding response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeResourceError(w http.ResponseWriter, status int, err error) {
+	writeResourceJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// kdbColumnStrings formats the items of a kdb+ list as strings, with temporal values as kdb+ literals
+func kdbColumnStrings(col *kdb.K) []string {
+	if col.Type == kdb.KD {
+		dates := col.Data.([]time.Time)
+		strs := make([]string, len(dates))
+		for i, date := range dates {
+			strs[i] = date.Format("2006.01.02")
+		}
+		return strs
+	}
+	return fieldStrings(data.NewField("", nil, standardColumnParser(col)))
+}
+
+// fieldStrings formats the values of a parsed field as strings, with timestamps as kdb+ literals
+func fieldStrings(field *data.Field) []string {
+	strs := make([]string, field.Len())
+	for i := range strs {
+		switch v := field.At(i).(type) {
+		case time.Time:
+			strs[i] = kdbTimestampLiteral(v)
+		default:
+			strs[i] = fmt.Sprint(v)
+		}
+	}
+	return strs
+}
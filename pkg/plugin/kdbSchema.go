@@ -0,0 +1,279 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	kdb "github.com/sv/kdbgo"
+)
+
+const defaultSchemaCacheTTL = 5 * time.Minute
+
+// kdbSchemaCache holds schema discovery results until they are older than ttl or the cache is refreshed
+type kdbSchemaCache struct {
+	ttl     time.Duration
+	entries map[string]*kdbSchemaCacheEntry
+	lock    sync.Mutex
+}
+
+type kdbSchemaCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newKdbSchemaCache(ttl time.Duration) *kdbSchemaCache {
+	if ttl <= 0 {
+		ttl = defaultSchemaCacheTTL
+	}
+	return &kdbSchemaCache{ttl: ttl, entries: make(map[string]*kdbSchemaCacheEntry)}
+}
+
+func (c *kdbSchemaCache) get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *kdbSchemaCache) put(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[key] = &kdbSchemaCacheEntry{value: value, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *kdbSchemaCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[string]*kdbSchemaCacheEntry)
+}
+
+// SchemaColumn is a column of a table as described by meta
+type SchemaColumn struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	ForeignKey string `json:"foreignKey"`
+	Attribute  string `json:"attribute"`
+}
+
+// SchemaPartitions describes the partitioned database loaded into a kdb+ process, if any
+type SchemaPartitions struct {
+	Partitioned bool     `json:"partitioned"`
+	Field       string   `json:"field"`
+	Tables      []string `json:"tables"`
+	Values      []string `json:"values"`
+}
+
+// SchemaFunction is a function in a namespace with its parameter names
+type SchemaFunction struct {
+	Name   string   `json:"name"`
+	Params []string `json:"params"`
+}
+
+func (d *KdbDatasource) registerSchemaRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/schema/namespaces", d.cachedSchemaHandler(d.fetchNamespaces))
+	mux.HandleFunc("/schema/tables", d.cachedSchemaHandler(d.fetchTables))
+	mux.HandleFunc("/schema/meta", d.cachedSchemaHandler(d.fetchMeta))
+	mux.HandleFunc("/schema/partitions", d.cachedSchemaHandler(d.fetchPartitions))
+	mux.HandleFunc("/schema/functions", d.cachedSchemaHandler(d.fetchFunctions))
+	mux.HandleFunc("/schema/refresh", d.handleSchemaRefresh)
+}
+
+// cachedSchemaHandler serves a schema endpoint from the cache, fetching from kdb+ on a miss or when refresh=true
+// is given. Passed-through users may see different schemas, so results are cached per user.
+func (d *KdbDatasource) cachedSchemaHandler(fetch func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		refresh := params.Get("refresh") == "true"
+		params.Del("refresh")
+		key := r.URL.Path + "?" + params.Encode()
+		if d.UserPassthrough {
+			if user := httpadapter.UserFromContext(r.Context()); user != nil {
+				key = user.Login + "@" + key
+			}
+		}
+		if !refresh {
+			if value, ok := d.schemaCache.get(key); ok {
+				writeResourceJSON(w, http.StatusOK, value)
+				return
+			}
+		}
+		value, err := fetch(r)
+		if err != nil {
+			writeResourceError(w, http.StatusInternalServerError, err)
+			return
+		}
+		d.schemaCache.put(key, value)
+		writeResourceJSON(w, http.StatusOK, value)
+	}
+}
+
+// handleSchemaRefresh empties the schema cache so that every endpoint is fetched afresh
+func (d *KdbDatasource) handleSchemaRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeResourceError(w, http.StatusMethodNotAllowed, fmt.Errorf("Schema refresh must be a POST"))
+		return
+	}
+	log.DefaultLogger.Debug("Clearing schema cache")
+	d.schemaCache.clear()
+	writeResourceJSON(w, http.StatusOK, map[string]string{"message": "Schema cache cleared"})
+}
+
+// fetchNamespaces returns the namespaces in the process (key `)
+func (d *KdbDatasource) fetchNamespaces(r *http.Request) (interface{}, error) {
+	res, err := d.runResourceQuery(r, "NAMESPACES", kdb.NewList(kdb.Symbol(".q.key"), kdb.Symbol("")))
+	if err != nil {
+		return nil, err
+	}
+	if res.Type != kdb.KS {
+		return nil, fmt.Errorf("Expected namespaces as a symbol list, received type %v", res.Type)
+	}
+	namespaces := []string{}
+	for _, ns := range res.Data.([]string) {
+		if ns != "" {
+			namespaces = append(namespaces, "."+ns)
+		}
+	}
+	return namespaces, nil
+}
+
+// fetchTables returns the tables in a namespace, the root namespace by default (tables `.ns)
+func (d *KdbDatasource) fetchTables(r *http.Request) (interface{}, error) {
+	ns := r.URL.Query().Get("namespace")
+	if ns == "" {
+		ns = "."
+	}
+	res, err := d.runResourceQuery(r, "TABLES", kdb.NewList(kdb.Symbol(".q.tables"), kdb.Symbol(ns)))
+	if err != nil {
+		return nil, err
+	}
+	if res.Type != kdb.KS {
+		return nil, fmt.Errorf("Expected tables as a symbol list, received type %v", res.Type)
+	}
+	return res.Data.([]string), nil
+}
+
+// fetchMeta returns the columns of a table (meta table)
+func (d *KdbDatasource) fetchMeta(r *http.Request) (interface{}, error) {
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		return nil, fmt.Errorf("No table given")
+	}
+	res, err := d.runResourceQuery(r, "META", kdb.NewList(kdb.Symbol(".q.meta"), kdb.Symbol(table)))
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := res.Data.(kdb.Dict)
+	if res.Type != kdb.XD || !ok || meta.Key.Type != kdb.XT || meta.Value.Type != kdb.XT {
+		return nil, fmt.Errorf("Expected meta of %v to be a keyed table", table)
+	}
+	names := kdbColumnStrings(meta.Key.Data.(kdb.Table).Data[0])
+	columns := make([]SchemaColumn, len(names))
+	for i, name := range names {
+		columns[i].Name = name
+	}
+	valueTable := meta.Value.Data.(kdb.Table)
+	for i, col := range valueTable.Columns {
+		for j, v := range kdbColumnStrings(valueTable.Data[i]) {
+			switch col {
+			case "t":
+				columns[j].Type = v
+			case "f":
+				columns[j].ForeignKey = v
+			case "a":
+				columns[j].Attribute = v
+			}
+		}
+	}
+	return columns, nil
+}
+
+// fetchPartitions returns the partition field, partitioned tables and partition values of the loaded database
+// (.Q.pf, .Q.pt and .Q.pv), which are undefined if no partitioned database is loaded
+func (d *KdbDatasource) fetchPartitions(r *http.Request) (interface{}, error) {
+	partitions := SchemaPartitions{Tables: []string{}, Values: []string{}}
+	pt, err := d.runResourceQuery(r, "PARTITIONS", kdb.Symbol(".Q.pt"))
+	if err != nil {
+		// kdb+ signals the name of an undefined variable
+		if err.Error() == ".Q.pt" {
+			return partitions, nil
+		}
+		return nil, err
+	}
+	if pt.Type == kdb.KS {
+		partitions.Tables = pt.Data.([]string)
+	}
+	pf, err := d.runResourceQuery(r, "PARTITIONS", kdb.Symbol(".Q.pf"))
+	if err != nil {
+		return nil, err
+	}
+	if pf.Type == -kdb.KS {
+		partitions.Field = pf.Data.(string)
+	}
+	pv, err := d.runResourceQuery(r, "PARTITIONS", kdb.Symbol(".Q.pv"))
+	if err != nil {
+		return nil, err
+	}
+	if pv.Type > kdb.K0 && pv.Type < kdb.XT {
+		partitions.Values = kdbColumnStrings(pv)
+	}
+	partitions.Partitioned = len(partitions.Tables) > 0
+	return partitions, nil
+}
+
+// functionValuesFunction breaks down each named function. value of a name is the function itself, so value is
+// applied again to give a lambda's (bytecode;params;locals;...).
+const functionValuesFunction = `{(value value@)each x}`
+
+// fetchFunctions returns the functions in a namespace (system "f .ns") with the parameters of each, taken from
+// the second item of value applied to the function
+func (d *KdbDatasource) fetchFunctions(r *http.Request) (interface{}, error) {
+	ns := r.URL.Query().Get("namespace")
+	cmd := "f"
+	if ns != "" && ns != "." {
+		cmd += " " + ns
+	}
+	res, err := d.runResourceQuery(r, "FUNCTIONS", kdb.NewList(kdb.Symbol(".q.system"), kdb.Atom(kdb.KC, cmd)))
+	if err != nil {
+		return nil, err
+	}
+	if res.Type != kdb.KS {
+		return nil, fmt.Errorf("Expected functions as a symbol list, received type %v", res.Type)
+	}
+	names := res.Data.([]string)
+	functions := make([]SchemaFunction, len(names))
+	if len(names) == 0 {
+		return functions, nil
+	}
+	qualified := make([]string, len(names))
+	for i, name := range names {
+		functions[i] = SchemaFunction{Name: name, Params: []string{}}
+		qualified[i] = name
+		if ns != "" && ns != "." {
+			qualified[i] = strings.TrimSuffix(ns, ".") + "." + name
+		}
+	}
+	values, err := d.runResourceQuery(r, "FUNCTIONS", kdb.NewList(kdb.NewFunc("", functionValuesFunction), kdb.SymbolV(qualified)))
+	if err != nil {
+		return nil, err
+	}
+	parts, ok := values.Data.([]*kdb.K)
+	if values.Type != kdb.K0 || !ok || len(parts) != len(names) {
+		return nil, fmt.Errorf("Unexpected result describing functions")
+	}
+	for i, v := range parts {
+		// value of a lambda is (bytecode;params;locals;...); other functions have no named parameters
+		if fn, ok := v.Data.([]*kdb.K); ok && v.Type == kdb.K0 && len(fn) > 1 && fn[1].Type == kdb.KS {
+			functions[i].Params = fn[1].Data.([]string)
+		}
+	}
+	return functions, nil
+}
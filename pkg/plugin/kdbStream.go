@@ -0,0 +1,470 @@
+package plugin
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+	kdb "github.com/sv/kdbgo"
+)
+
+// queryTypeStream is the Grafana query type of queries which subscribe the panel to a Grafana Live channel
+const queryTypeStream = "stream"
+
+// streamPathTick is the first part of the channel path of tickerplant subscriptions,
+// tick/<table>[/<sym>...][/<option>=<value>...]
+const streamPathTick = "tick"
+
+// streamPathUser is the path option naming the passed-through user a tickerplant subscription is made as. Logins
+// are hex encoded, as they may contain characters not allowed in channel paths.
+const streamPathUser = "user"
+
+// StreamQuery subscribes a panel to a Grafana Live channel, either of a tickerplant table and the syms to
+// subscribe to (all syms if none are given), or of the panel's query polled every Interval milliseconds, of
+// which only rows with a new KeyColumn value or a later TimeColumn value are pushed. With Backfill, a tickerplant
+// subscription first pushes the result of the panel's query, then only updates with a later SequenceColumn or
+// TimeColumn value. Any stream may be conflated before it is pushed.
+type StreamQuery struct {
+	Mode           string   `json:"mode"`
+	Table          string   `json:"table"`
+	Syms           []string `json:"syms"`
+	Interval       int      `json:"interval"`
+	KeyColumn      string   `json:"keyColumn"`
+	TimeColumn     string   `json:"timeColumn"`
+	Backfill       bool     `json:"backfill"`
+	SequenceColumn string   `json:"sequenceColumn"`
+	StreamConflation
+	// login is the Grafana login the tickerplant is subscribed to as when user passthrough is enabled
+	login string
+}
+
+// path is the channel path of the subscription, with the conflation options, which change what subscribers
+// receive, as <option>=<value> parts
+func (s *StreamQuery) path() string {
+	parts := append([]string{streamPathTick, s.Table}, s.Syms...)
+	if s.TimeColumn != "" {
+		parts = append(parts, "timeColumn="+s.TimeColumn)
+	}
+	if s.login != "" {
+		parts = append(parts, streamPathUser+"="+hex.EncodeToString([]byte(s.login)))
+	}
+	return strings.Join(append(parts, s.StreamConflation.pathOptions()...), "/")
+}
+
+// parseTickPath reads a tickerplant subscription from a channel path
+func parseTickPath(path string) (*StreamQuery, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || parts[0] != streamPathTick || parts[1] == "" {
+		return nil, fmt.Errorf("Unknown stream path '%v'", path)
+	}
+	s := &StreamQuery{Table: parts[1], Syms: []string{}}
+	for _, part := range parts[2:] {
+		option := strings.SplitN(part, "=", 2)
+		switch {
+		case part == "":
+		case len(option) == 1:
+			s.Syms = append(s.Syms, part)
+		case option[0] == "timeColumn":
+			s.TimeColumn = option[1]
+		case option[0] == streamPathUser:
+			login, err := hex.DecodeString(option[1])
+			if err != nil || len(login) == 0 {
+				return nil, fmt.Errorf("Stream path '%v' has an invalid user", path)
+			}
+			s.login = string(login)
+		default:
+			if err := s.StreamConflation.setPathOption(option[0], option[1]); err != nil {
+				return nil, fmt.Errorf("Stream path '%v': %v", path, err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// streamFrame is the empty frame returned to a stream query, whose channel Grafana then subscribes the panel to
+func (d *KdbDatasource) streamFrame(pCtx backend.PluginContext, query backend.DataQuery, model QueryModel) (*data.Frame, error) {
+	s := model.Stream
+	if s == nil {
+		return nil, fmt.Errorf("No stream options given")
+	}
+	if pCtx.DataSourceInstanceSettings == nil {
+		return nil, fmt.Errorf("Streams require a datasource UID")
+	}
+	if err := s.StreamConflation.validate(); err != nil {
+		return nil, err
+	}
+	// subscriptions are made as the passed-through user, who alone may subscribe to the channel
+	if d.UserPassthrough {
+		if _, err := d.userContext(context.Background(), pCtx.User); err != nil {
+			return nil, err
+		}
+		s.login = pCtx.User.Login
+	}
+	var path string
+	var err error
+	switch s.Mode {
+	case "", streamModeTick:
+		if s.Backfill {
+			if path, err = d.registerBackfillStream(pCtx, query, model); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if s.Table == "" {
+			return nil, fmt.Errorf("No table given to stream")
+		}
+		for _, sym := range s.Syms {
+			// parts of the channel path with '=' are options
+			if strings.Contains(sym, "=") {
+				return nil, fmt.Errorf("Syms to stream may not contain '='")
+			}
+		}
+		path = s.path()
+	case streamModePoll:
+		if path, err = d.registerPollStream(pCtx, query, model); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported stream mode '%v'", s.Mode)
+	}
+	channel := live.Channel{Scope: live.ScopeDatasource, Namespace: pCtx.DataSourceInstanceSettings.UID, Path: path}
+	if !channel.IsValid() {
+		return nil, fmt.Errorf("Table and syms to stream may only contain letters, digits and '_', '-', '=' or '.'")
+	}
+	frame := data.NewFrame(query.RefID)
+	frame.Meta = &data.FrameMeta{Channel: channel.String()}
+	return frame, nil
+}
+
+func (d *KdbDatasource) SubscribeStream(ctx context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	var err error
+	var backfill *kdbRegisteredStream
+	login := ""
+	owned := false
+	switch streamPathKind(req.Path) {
+	case streamPathTick:
+		var s *StreamQuery
+		if s, err = parseTickPath(req.Path); err == nil {
+			login = s.login
+		}
+	case streamPathPoll, streamPathBackfill:
+		var rs *kdbRegisteredStream
+		if rs, err = d.getRegisteredStream(req.Path); err == nil {
+			login, owned = rs.login, true
+			if streamPathKind(req.Path) == streamPathBackfill {
+				backfill = rs
+			}
+		}
+	default:
+		err = fmt.Errorf("Unknown stream path '%v'", req.Path)
+	}
+	if err != nil {
+		log.DefaultLogger.Debug(err.Error())
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	if _, err := d.userContext(ctx, req.PluginContext.User); err != nil {
+		log.DefaultLogger.Debug(fmt.Sprintf("Refusing subscription to %v: %v", req.Path, err))
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusPermissionDenied}, nil
+	}
+	// streams run as the user who requested them, so only they may subscribe
+	if d.UserPassthrough && login == "" {
+		log.DefaultLogger.Debug(fmt.Sprintf("Refusing subscription to %v, which is not made as a passed-through user", req.Path))
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusPermissionDenied}, nil
+	}
+	subscriber := ""
+	if req.PluginContext.User != nil {
+		subscriber = req.PluginContext.User.Login
+	}
+	if (owned || login != "") && subscriber != login {
+		log.DefaultLogger.Debug(fmt.Sprintf("Refusing subscription to %v, which is made as another user", req.Path))
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusPermissionDenied}, nil
+	}
+	if backfill != nil {
+		initial, err := d.backfillFrame(ctx, backfill)
+		if err != nil {
+			return nil, err
+		}
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK, InitialData: initial}, nil
+	}
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK}, nil
+}
+
+// PublishStream refuses publications; channels only carry data from kdb+
+func (d *KdbDatasource) PublishStream(context.Context, *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
+
+// RunStream subscribes to the channel's tickerplant table on a dedicated handle, catching up the first subscribers'
+// backfill if the channel has a historical query, or polls the channel's query, pushing updates to Grafana Live until the last
+// subscriber leaves
+func (d *KdbDatasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	var s *StreamQuery
+	var rs *kdbRegisteredStream
+	var err error
+	kind := streamPathKind(req.Path)
+	switch kind {
+	case streamPathPoll, streamPathBackfill:
+		if rs, err = d.getRegisteredStream(req.Path); err != nil {
+			return err
+		}
+		defer d.trackRegisteredStream(rs)()
+		s = rs.stream
+	default:
+		if s, err = parseTickPath(req.Path); err != nil {
+			return err
+		}
+	}
+	var out frameSender = sender
+	if c := newStreamConflator(s, sender); c != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go c.run(ctx)
+		out = c
+	}
+	if kind == streamPathPoll {
+		return d.runPollStream(ctx, req.Path, rs, out)
+	}
+	return d.runTickStream(ctx, s, rs, out)
+}
+
+// streamPathKind is the first part of a channel path, telling tickerplant subscriptions from registered queries
+func streamPathKind(path string) string {
+	return strings.SplitN(path, "/", 2)[0]
+}
+
+// tickerplantEndpoint is the process tickerplant subscriptions are made to; the active endpoint unless a separate
+// tickerplant is configured, which is on the active endpoint's host if no tickerplant host is given
+func (d *KdbDatasource) tickerplantEndpoint() *kdbEndpoint {
+	if d.TickerplantPort > 0 {
+		host := d.TickerplantHost
+		if e := d.getActiveEndpoint(); host == "" && e != nil {
+			host = e.Host
+		}
+		return &kdbEndpoint{Host: host, Port: d.TickerplantPort}
+	}
+	return d.getActiveEndpoint()
+}
+
+// openStreamConnection dials the tickerplant with the datasource's credentials, or those of the passed-through
+// user if a login is given. Subscription handles are not pooled, as kdb+ publishes to them at any time.
+func (d *KdbDatasource) openStreamConnection(login string) (kdbConn, error) {
+	e := d.tickerplantEndpoint()
+	if e == nil {
+		return nil, fmt.Errorf("No tickerplant configured")
+	}
+	log.DefaultLogger.Info(fmt.Sprintf("Opening stream connection to %v ...", e))
+	auth := d.userCredentials(login)
+	switch {
+	case d.ConnectionMode == connectionModeUnix:
+		return dialKdbSocket("unix", e.socketPath(), auth, d.DialTimeout, 0, nil)
+	case d.WithTls:
+		return dialKdbSocket("tcp", net.JoinHostPort(e.Host, strconv.Itoa(e.Port)), auth, d.DialTimeout, d.tcpKeepAlive, d.TlsServerConfig)
+	}
+	return dialKdbSocket("tcp", net.JoinHostPort(e.Host, strconv.Itoa(e.Port)), auth, d.DialTimeout, d.tcpKeepAlive, nil)
+}
+
+// runTickStream calls .u.sub[table;syms] and converts the upd messages kdb+ then publishes into frames. With a
+// backfill query, its result is pushed first while updates are held, and held updates already in the result are
+// dropped.
+func (d *KdbDatasource) runTickStream(ctx context.Context, s *StreamQuery, backfill *kdbRegisteredStream, sender frameSender) error {
+	conn, err := d.OpenStreamConnection(s.login)
+	if err != nil {
+		return fmt.Errorf("Error opening stream connection: %v", err)
+	}
+	// closing the handle when the stream ends unblocks the read below
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	columns, err := subscribeTick(conn, s)
+	if err != nil {
+		return err
+	}
+	log.DefaultLogger.Info(fmt.Sprintf("Subscribed to %v for syms %v", s.Table, s.Syms))
+	// updates are read from subscribing on, so none are missed while the backfill query runs
+	updates := make(chan *data.Frame, tickUpdateBuffer)
+	lost := make(chan error, 1)
+	go func() {
+		lost <- readTickUpdates(conn, s, columns, updates, done)
+	}()
+
+	var mark *streamWatermark
+	if backfill != nil {
+		if mark, err = d.sendBackfill(ctx, backfill, sender); err != nil {
+			return err
+		}
+	}
+	include := data.IncludeAll
+	for {
+		var frame *data.Frame
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-lost:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("Stream of %v lost: %v", s.Table, err)
+		case frame = <-updates:
+		}
+		if mark != nil {
+			rows, err := mark.newRows(frame)
+			switch {
+			case err != nil:
+				log.DefaultLogger.Error(fmt.Sprintf("Updates to %v cannot be de-duplicated: %v", s.Table, err))
+				mark = nil
+			case rows.Rows() == frame.Rows():
+				// updates are in order, so once one is entirely new the overlap with the backfill has passed
+				mark = nil
+			case rows.Rows() == 0:
+				continue
+			default:
+				frame = rows
+			}
+		}
+		err = sender.SendFrame(frame, include)
+		if err != nil {
+			return err
+		}
+		// the schema only needs sending with the first frame
+		include = data.IncludeDataOnly
+	}
+}
+
+// tickUpdateBuffer is the number of parsed updates held for a stream, such as while its backfill query runs,
+// before reading from the tickerplant stops
+const tickUpdateBuffer = 1024
+
+// readTickUpdates parses the updates published to a subscription until the handle fails or done is closed
+func readTickUpdates(conn kdbConn, s *StreamQuery, columns []string, updates chan<- *data.Frame, done <-chan struct{}) error {
+	for {
+		msg, msgtype, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if msgtype != kdb.ASYNC {
+			continue
+		}
+		frame, err := parseTickUpdate(msg, s.Table, columns)
+		if err != nil {
+			log.DefaultLogger.Error(fmt.Sprintf("Error parsing update to %v: %v", s.Table, err))
+			continue
+		}
+		if frame == nil {
+			continue
+		}
+		select {
+		case updates <- frame:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// subscribeTick sends .u.sub, returning the columns of the table from the empty schema kdb+ replies with
+func subscribeTick(conn kdbConn, s *StreamQuery) ([]string, error) {
+	syms := kdb.Symbol("")
+	if len(s.Syms) > 0 {
+		syms = kdb.SymbolV(s.Syms)
+	}
+	err := conn.WriteMessage(kdb.SYNC, kdb.NewList(kdb.Symbol(".u.sub"), kdb.Symbol(s.Table), syms))
+	if err != nil {
+		return nil, fmt.Errorf("Error subscribing to %v: %v", s.Table, err)
+	}
+	for {
+		res, msgtype, err := conn.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("Error subscribing to %v: %v", s.Table, err)
+		}
+		if msgtype != kdb.RESPONSE {
+			continue
+		}
+		// .u.sub returns (table;schema)
+		parts, ok := res.Data.([]*kdb.K)
+		if res.Type != kdb.K0 || !ok || len(parts) != 2 || parts[1].Type != kdb.XT {
+			return nil, fmt.Errorf("Unexpected reply subscribing to %v", s.Table)
+		}
+		return parts[1].Data.(kdb.Table).Columns, nil
+	}
+}
+
+// parseTickUpdate converts an upd[table;data] message to a frame, or nil if it updates another table. Updates may
+// be a table, a list of columns or a single row of atoms. Tickerplants timestamp rows with the timespan since
+// midnight, so a timespan time column is taken to be today's.
+func parseTickUpdate(msg *kdb.K, table string, columns []string) (*data.Frame, error) {
+	parts, ok := msg.Data.([]*kdb.K)
+	if msg.Type != kdb.K0 || !ok || len(parts) != 3 || parts[0].Type != -kdb.KS || parts[1].Type != -kdb.KS {
+		return nil, fmt.Errorf("Expected upd message of (`upd;`table;data)")
+	}
+	if parts[1].Data.(string) != table {
+		return nil, nil
+	}
+	var tbl kdb.Table
+	switch upd := parts[2]; upd.Type {
+	case kdb.XT:
+		tbl = upd.Data.(kdb.Table)
+	case kdb.K0:
+		cols := upd.Data.([]*kdb.K)
+		if len(cols) != len(columns) {
+			return nil, fmt.Errorf("Update has %v columns, expected %v", len(cols), len(columns))
+		}
+		// like .u.upd, a single row is told apart from columns by its first item being an atom
+		row := len(cols) > 0 && cols[0].Type < 0
+		colData := make([]*kdb.K, len(cols))
+		for i, col := range cols {
+			colData[i] = col
+			if row {
+				colData[i] = enlistItem(col)
+			}
+		}
+		tbl = kdb.Table{Columns: columns, Data: colData}
+	default:
+		return nil, fmt.Errorf("Unsupported update of type %v", upd.Type)
+	}
+	for i, name := range tbl.Columns {
+		if name == defaultTimeColumn && tbl.Data[i].Type == kdb.KN {
+			midnight := time.Now().UTC().Truncate(24 * time.Hour)
+			spans := tbl.Data[i].Data.([]time.Duration)
+			times := make([]time.Time, len(spans))
+			for j, span := range spans {
+				times[j] = midnight.Add(span)
+			}
+			tbl.Data[i] = kdb.Atom(kdb.KP, times)
+		}
+	}
+	frame, err := ParseSimpleKdbTable(&kdb.K{Type: kdb.XT, Attr: kdb.NONE, Data: tbl})
+	if err != nil {
+		return nil, err
+	}
+	frame.Name = table
+	return frame, nil
+}
+
+// enlistItem makes a one item column of an item of a row: a list of the atom's type, or a list of one string
+func enlistItem(item *kdb.K) *kdb.K {
+	switch {
+	case item.Type == -kdb.KC:
+		return kdb.Atom(kdb.KC, string(item.Data.(byte)))
+	case item.Type < 0:
+		list := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(item.Data)), 1, 1)
+		list.Index(0).Set(reflect.ValueOf(item.Data))
+		return &kdb.K{Type: -item.Type, Attr: kdb.NONE, Data: list.Interface()}
+	}
+	return kdb.NewList(item)
+}
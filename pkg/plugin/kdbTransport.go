@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"runtime"
+	"time"
+
+	kdb "github.com/sv/kdbgo"
+)
+
+const (
+	connectionModeTCP  = "tcp"
+	connectionModeUnix = "unix"
+)
+
+// kdbConn is the part of kdb.KDBConn used by handles, so that transports kdbgo cannot dial
+// can be used interchangeably
+type kdbConn interface {
+	ReadMessage() (*kdb.K, kdb.ReqType, error)
+	WriteMessage(kdb.ReqType, *kdb.K) error
+	Close() error
+}
+
+// kdbSocketConn speaks kdb+ IPC over any stream socket
+type kdbSocketConn struct {
+	con  net.Conn
+	rbuf *bufio.Reader
+}
+
+func (c *kdbSocketConn) ReadMessage() (*kdb.K, kdb.ReqType, error) {
+	return kdb.Decode(c.rbuf)
+}
+
+func (c *kdbSocketConn) WriteMessage(msgtype kdb.ReqType, obj *kdb.K) error {
+	return kdb.Encode(c.con, msgtype, obj)
+}
+
+func (c *kdbSocketConn) Close() error {
+	return c.con.Close()
+}
+
+// dialKdbSocket dials a kdb+ process and performs the same auth handshake as kdbgo. TCP connections
+// send keepalive probes every keepAlive (zero uses Go's default period and a negative duration
+// disables them); if tlsConfig is not nil the connection is made over TLS.
+func dialKdbSocket(network string, address string, auth string, timeout time.Duration, keepAlive time.Duration, tlsConfig *tls.Config) (*kdbSocketConn, error) {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: keepAlive}
+	var c net.Conn
+	var err error
+	if tlsConfig != nil {
+		c, err = tls.DialWithDialer(dialer, network, address, tlsConfig)
+	} else {
+		c, err = dialer.Dial(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = kdbHandshake(c, auth, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kdbSocketConn{con: c, rbuf: bufio.NewReader(c)}, nil
+}
+
+// kdbHandshake sends credentials and capability 3 (uuid support etc.), expecting a single byte in reply
+// within timeout so that a peer which accepts the connection but never answers cannot block the dial
+func kdbHandshake(c net.Conn, auth string, timeout time.Duration) error {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	buf := bytes.NewBufferString(auth)
+	buf.WriteByte(3)
+	buf.WriteByte(0)
+	_, err := c.Write(buf.Bytes())
+	if err != nil {
+		c.Close()
+		return err
+	}
+	reply := make([]byte, 2+len(auth))
+	n, err := c.Read(reply)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if n != 1 {
+		c.Close()
+		return fmt.Errorf("Authentication error. Max supported version - %v", reply[0])
+	}
+	// queries have their own timeouts, so the connection itself is left without a deadline
+	c.SetDeadline(time.Time{})
+	return nil
+}
+
+// defaultSocketPath is the Unix domain socket kdb+ listens on for a port; on Linux this is in the abstract namespace
+func defaultSocketPath(port int) string {
+	if runtime.GOOS == "linux" {
+		return fmt.Sprintf("@/tmp/kx.%d", port)
+	}
+	return fmt.Sprintf("/tmp/kx.%d", port)
+}
@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// credential schemes for user passthrough; the Grafana login is always the kdb+ username
+const (
+	credentialSchemeSharedPassword = "sharedPassword"
+	credentialSchemeLoginOnly      = "loginOnly"
+)
+
+// kdbUserKey is the context key under which the Grafana login a query runs as is stored
+type kdbUserKey struct{}
+
+// kdbUserRejectedError is returned when kdb+ refuses a passed-through user's credentials, which says
+// nothing about the health of the endpoint
+type kdbUserRejectedError struct {
+	user string
+	err  error
+}
+
+func (e *kdbUserRejectedError) Error() string {
+	return fmt.Sprintf("kdb+ rejected credentials for user %v: %v", e.user, e.err)
+}
+
+func (e *kdbUserRejectedError) Unwrap() error {
+	return e.err
+}
+
+// userContext returns ctx tagged with the Grafana login queries should be run as when user passthrough is enabled
+func (d *KdbDatasource) userContext(ctx context.Context, user *backend.User) (context.Context, error) {
+	if !d.UserPassthrough {
+		return ctx, nil
+	}
+	if user == nil || user.Login == "" {
+		return nil, fmt.Errorf("User passthrough is enabled but the request has no Grafana user")
+	}
+	if strings.ContainsAny(user.Login, ":\x00") {
+		return nil, fmt.Errorf("Grafana login %q cannot be used as a kdb+ username", user.Login)
+	}
+	return context.WithValue(ctx, kdbUserKey{}, user.Login), nil
+}
+
+// poolFor returns the pool a query should be queued on: the shared pool, or the passed-through user's own pool
+func (d *KdbDatasource) poolFor(ctx context.Context, e *kdbEndpoint) *kdbPool {
+	user, ok := ctx.Value(kdbUserKey{}).(string)
+	if !ok || user == "" {
+		return e.pool
+	}
+	e.userPoolLock.Lock()
+	defer e.userPoolLock.Unlock()
+	if p, ok := e.userPools[user]; ok {
+		return p
+	}
+	if e.userPools == nil {
+		e.userPools = make(map[string]*kdbPool)
+	}
+	// user pools are filled on demand and evicted once their last handle has been idle for the idle timeout
+	p := newKdbPool(1, e.pool.maxSize, e.pool.idleTimeout)
+	p.minSize = 0
+	p.endpoint = e
+	p.user = user
+	p.breaker = newKdbBreaker(d.BreakerThreshold, d.reconnectBackoffMin, d.reconnectBackoffMax)
+	e.userPools[user] = p
+	log.DefaultLogger.Debug(fmt.Sprintf("Created handle pool for user %v on %v", user, e))
+	return p
+}
+
+// evictUserPool forgets a user's pool once it has no handles left
+func (e *kdbEndpoint) evictUserPool(p *kdbPool) {
+	e.userPoolLock.Lock()
+	defer e.userPoolLock.Unlock()
+	if p.Size() > 0 || e.userPools[p.user] != p {
+		return
+	}
+	delete(e.userPools, p.user)
+	log.DefaultLogger.Debug(fmt.Sprintf("Evicted idle handle pool for user %v on %v", p.user, e))
+}
+
+// credentials returns the username:password a pool's handles authenticate with
+func (d *KdbDatasource) credentials(p *kdbPool) string {
+	return d.userCredentials(p.user)
+}
+
+// userCredentials returns the username:password a passed-through user authenticates with, or the datasource's
+// own credentials if user is empty
+func (d *KdbDatasource) userCredentials(user string) string {
+	if user == "" {
+		return fmt.Sprintf("%s:%s", d.user, d.pass)
+	}
+	if d.CredentialScheme == credentialSchemeLoginOnly {
+		return user
+	}
+	return fmt.Sprintf("%s:%s", user, d.pass)
+}
@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+)
+
+// VariableQuery is a template variable query, run over the dashboard's time range (in ms since the Unix epoch)
+type VariableQuery struct {
+	QueryText string `json:"queryText"`
+	Timeout   int    `json:"timeOut"`
+	From      int64  `json:"from"`
+	To        int64  `json:"to"`
+}
+
+// VariableOption is one option of a template variable
+type VariableOption struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+// handleVariableQuery runs a variable query in the same way as a panel query and returns the first column of the
+// result as option text and the second column, if any, as option values. Options are de-duplicated and sorted by
+// text; grouped tables contribute the options of every group.
+func (d *KdbDatasource) handleVariableQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeResourceError(w, http.StatusMethodNotAllowed, fmt.Errorf("Variable queries must be a POST"))
+		return
+	}
+	var vq VariableQuery
+	err := json.NewDecoder(r.Body).Decode(&vq)
+	if err != nil {
+		writeResourceError(w, http.StatusBadRequest, fmt.Errorf("Error decoding variable query: %v", err))
+		return
+	}
+	model, err := json.Marshal(QueryModel{QueryText: vq.QueryText, Timeout: vq.Timeout})
+	if err != nil {
+		writeResourceError(w, http.StatusInternalServerError, err)
+		return
+	}
+	q := backend.DataQuery{
+		RefID: "variable",
+		JSON:  model,
+		TimeRange: backend.TimeRange{
+			From: time.Unix(0, vq.From*int64(time.Millisecond)),
+			To:   time.Unix(0, vq.To*int64(time.Millisecond)),
+		},
+	}
+	res := d.safeQuery(r.Context(), httpadapter.PluginConfigFromContext(r.Context()), q)
+	if res.Error != nil {
+		writeResourceError(w, http.StatusInternalServerError, res.Error)
+		return
+	}
+
+	seen := map[VariableOption]bool{}
+	options := []VariableOption{}
+	for _, frame := range res.Frames {
+		if len(frame.Fields) == 0 {
+			continue
+		}
+		texts := fieldStrings(frame.Fields[0])
+		values := texts
+		if len(frame.Fields) > 1 {
+			values = fieldStrings(frame.Fields[1])
+		}
+		for i, text := range texts {
+			option := VariableOption{Text: text, Value: values[i]}
+			if !seen[option] {
+				seen[option] = true
+				options = append(options, option)
+			}
+		}
+	}
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Text < options[j].Text })
+	writeResourceJSON(w, http.StatusOK, options)
+}
@@ -0,0 +1,47 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+
+	kdb "github.com/sv/kdbgo"
+)
+
+// defaultVariableType is used for template variables without a type hint
+const defaultVariableType = argTypeString
+
+// QueryVariable is the current value of a dashboard template variable, with a hint of the kdb+ type to cast it to
+type QueryVariable struct {
+	Values []string `json:"values"`
+	Multi  bool     `json:"multi"`
+	Type   string   `json:"type"`
+}
+
+// buildVariablesKdbDict converts template variables to a dict of variable name to value, cast to each variable's
+// type; multi-value variables become lists of that type
+func buildVariablesKdbDict(variables map[string]QueryVariable) (*kdb.K, error) {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]*kdb.K, len(names))
+	for i, name := range names {
+		v := variables[name]
+		arg := QueryArgument{Type: v.Type, Values: v.Values}
+		if arg.Type == "" {
+			arg.Type = defaultVariableType
+		}
+		if v.Multi {
+			arg.Type += "List"
+		} else if len(v.Values) > 0 {
+			arg = QueryArgument{Type: arg.Type, Value: v.Values[0]}
+		}
+		k, err := arg.toK()
+		if err != nil {
+			return nil, fmt.Errorf("Variable %v: %v", name, err)
+		}
+		values[i] = k
+	}
+	return kdb.NewDict(kdb.SymbolV(names), kdb.NewList(values...)), nil
+}
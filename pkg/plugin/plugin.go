@@ -5,8 +5,13 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -21,21 +26,34 @@ const ADAPTOR_VERSION = float64(1.0)
 var (
 	_ backend.QueryDataHandler      = (*KdbDatasource)(nil)
 	_ backend.CheckHealthHandler    = (*KdbDatasource)(nil)
+	_ backend.CallResourceHandler   = (*KdbDatasource)(nil)
+	_ backend.StreamHandler         = (*KdbDatasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*KdbDatasource)(nil)
 )
 
 type QueryModel struct {
-	QueryText         string `json:"queryText"`
-	Timeout           int    `json:"timeOut"`
-	UseTimeColumn     bool   `json:"useTimeColumn"`
-	TimeColumn        string `json:"timeColumn"`
-	IncludeKeyColumns bool   `json:"includeKeyColumns"`
+	QueryText         string                   `json:"queryText"`
+	Timeout           int                      `json:"timeOut"`
+	UseTimeColumn     bool                     `json:"useTimeColumn"`
+	TimeColumn        string                   `json:"timeColumn"`
+	IncludeKeyColumns bool                     `json:"includeKeyColumns"`
+	QueryMode         string                   `json:"queryMode"`
+	Function          string                   `json:"function"`
+	Arguments         []QueryArgument          `json:"arguments"`
+	Variables         map[string]QueryVariable `json:"variables"`
+	Builder           *BuilderQuery            `json:"builder"`
+	AdhocFilters      []AdhocFilter            `json:"adhocFilters"`
+	Logs              *LogsQuery               `json:"logs"`
+	Stream            *StreamQuery             `json:"stream"`
 }
 
 type kdbSyncQuery struct {
+	ctx     context.Context
 	query   *kdb.K
 	id      uint32
 	timeout time.Duration
+	resChan chan *kdbSyncRes
+	replied chan struct{}
 }
 
 type kdbRawRead struct {
@@ -50,32 +68,65 @@ type kdbSyncRes struct {
 }
 
 type KdbDatasource struct {
-	Host                string `json:"host"`
-	Port                int    `json:"port"`
-	Timeout             string `json:"timeout"`
-	WithTls             bool   `json:"withTLS"`
-	SkipVertifyTLS      bool   `json:"skipVerifyTLS"`
-	WithCACert          bool   `json:"withCACert"`
-	user                string
-	pass                string
-	TlsCertificate      string
-	TlsKey              string
-	CaCert              string
-	TlsServerConfig     *tls.Config
-	DialTimeout         time.Duration
-	KdbHandle           *kdb.KDBConn
-	signals             chan int
-	syncQueue           chan *kdbSyncQuery
-	rawReadChan         chan *kdbRawRead
-	syncResChan         chan *kdbSyncRes
-	kdbSyncQueryCounter uint32
-	IsOpen              bool
-	KdbHandleListener   func()
-	RunKdbQuerySync     func(*kdb.K, time.Duration) (*kdb.K, error)
-	OpenConnection      func() error
-	CloseConnection     func() error
-	WriteConnection     func(kdb.ReqType, *kdb.K) error
-	ReadConnection      func() (*kdb.K, kdb.ReqType, error)
+	Host                 string         `json:"host"`
+	Port                 int            `json:"port"`
+	Timeout              string         `json:"timeout"`
+	WithTls              bool           `json:"withTLS"`
+	SkipVertifyTLS       bool           `json:"skipVerifyTLS"`
+	WithCACert           bool           `json:"withCACert"`
+	ConnectionMode       string         `json:"connectionMode"`
+	SocketPath           string         `json:"socketPath"`
+	PoolMinSize          int            `json:"poolMinSize"`
+	PoolMaxSize          int            `json:"poolMaxSize"`
+	PoolIdleTimeout      string         `json:"poolIdleTimeout"`
+	MaxConcurrentQueries int            `json:"maxConcurrentQueries"`
+	AsyncQueries         bool           `json:"asyncQueries"`
+	Endpoints            []*kdbEndpoint `json:"endpoints"`
+	FailbackInterval     string         `json:"failbackInterval"`
+	LoadBalancing        string         `json:"loadBalancing"`
+	ReconnectBackoffMin  string         `json:"reconnectBackoffMin"`
+	ReconnectBackoffMax  string         `json:"reconnectBackoffMax"`
+	BreakerThreshold     int            `json:"breakerThreshold"`
+	HeartbeatInterval    string         `json:"heartbeatInterval"`
+	TcpKeepAlive         string         `json:"tcpKeepAlive"`
+	SchemaCacheTTL       string         `json:"schemaCacheTTL"`
+	ParseTimeout         string         `json:"parseTimeout"`
+	ValidateQueries      bool           `json:"validateQueries"`
+	UserPassthrough      bool           `json:"userPassthrough"`
+	CredentialScheme     string         `json:"credentialScheme"`
+	EntryFunction        string         `json:"entryFunction"`
+	HealthCheckFunction  string         `json:"healthCheckFunction"`
+	TickerplantHost      string         `json:"tickerplantHost"`
+	TickerplantPort      int            `json:"tickerplantPort"`
+	user                 string
+	pass                 string
+	TlsCertificate       string
+	TlsKey               string
+	CaCert               string
+	TlsServerConfig      *tls.Config
+	DialTimeout          time.Duration
+	signals              chan int
+	settings             *backend.DataSourceInstanceSettings
+	roundRobinCounter    uint32
+	endpointLock         sync.Mutex
+	failbackInterval     time.Duration
+	reconnectBackoffMin  time.Duration
+	reconnectBackoffMax  time.Duration
+	heartbeatInterval    time.Duration
+	tcpKeepAlive         time.Duration
+	schemaCacheTTL       time.Duration
+	schemaCache          *kdbSchemaCache
+	registeredStreams    kdbRegisteredStreams
+	parseTimeout         time.Duration
+	kdbSyncQueryCounter  uint32
+	KdbHandleListener    func(*kdbHandle)
+	RunKdbQuerySync      func(context.Context, *kdb.K, time.Duration) (*kdb.K, error)
+	OpenConnection       func(*kdbHandle) error
+	CloseConnection      func(*kdbHandle) error
+	WriteConnection      func(*kdbHandle, kdb.ReqType, *kdb.K) error
+	ReadConnection       func(*kdbHandle) (*kdb.K, kdb.ReqType, error)
+	OpenStreamConnection func(string) (kdbConn, error)
+	resourceHandler      backend.CallResourceHandler
 }
 
 // NewKdbDatasource creates a new datasource instance.
@@ -154,24 +205,95 @@ func NewKdbDatasource(settings backend.DataSourceInstanceSettings) (instancemgmt
 		timeOutDuration = time.Second
 	}
 	client.DialTimeout = timeOutDuration
+	heartbeatInterval, err := time.ParseDuration(client.HeartbeatInterval + "ms")
+	if nil != err {
+		log.DefaultLogger.Debug("Heartbeats disabled")
+		heartbeatInterval = 0
+	}
+	client.heartbeatInterval = heartbeatInterval
+	tcpKeepAlive, err := time.ParseDuration(client.TcpKeepAlive + "ms")
+	if nil != err {
+		log.DefaultLogger.Debug("Using default TCP keepalive period")
+		tcpKeepAlive = 0
+	}
+	client.tcpKeepAlive = tcpKeepAlive
+	schemaCacheTTL, err := time.ParseDuration(client.SchemaCacheTTL + "ms")
+	if nil != err {
+		log.DefaultLogger.Debug("Using default schema cache TTL")
+		schemaCacheTTL = defaultSchemaCacheTTL
+	}
+	client.schemaCacheTTL = schemaCacheTTL
+	parseTimeout, err := time.ParseDuration(client.ParseTimeout + "ms")
+	if nil != err {
+		log.DefaultLogger.Debug("Using default parse timeout")
+		parseTimeout = defaultParseTimeout
+	}
+	client.parseTimeout = parseTimeout
+	if client.ConnectionMode == connectionModeUnix && client.WithTls {
+		log.DefaultLogger.Info("TLS is not used for Unix domain socket connections")
+	}
+	// function names may be entered as symbols
+	client.EntryFunction = strings.TrimPrefix(strings.TrimSpace(client.EntryFunction), "`")
+	client.HealthCheckFunction = strings.TrimPrefix(strings.TrimSpace(client.HealthCheckFunction), "`")
+	// async queries are wrapped in a lambda to reply on the handle, which an entry function's .z.ps would refuse
+	if client.AsyncQueries && (client.EntryFunction != "" || client.HealthCheckFunction != "") {
+		return nil, fmt.Errorf("Asynchronous queries cannot be used with an entry or health check function")
+	}
 	// Set IPC handler functions
 	client.setupKdbConnectionHandlers()
-	client.IsOpen = false
+	client.setupResourceHandlers()
+
+	client.settings = &settings
 
-	// make channel for synchronous queries
-	log.DefaultLogger.Info("Making synchronous query channel")
-	client.syncQueue = make(chan *kdbSyncQuery)
+	// make a handle pool and synchronous query channel for each endpoint
+	poolIdleTimeout, err := time.ParseDuration(client.PoolIdleTimeout + "ms")
+	if nil != err {
+		log.DefaultLogger.Debug("Using default pool idle timeout")
+		poolIdleTimeout = defaultPoolIdleTimeout
+	}
+	reconnectBackoffMin, err := time.ParseDuration(client.ReconnectBackoffMin + "ms")
+	if nil != err {
+		log.DefaultLogger.Debug("Using default minimum reconnect backoff")
+		reconnectBackoffMin = defaultReconnectBackoffMin
+	}
+	client.reconnectBackoffMin = reconnectBackoffMin
+	reconnectBackoffMax, err := time.ParseDuration(client.ReconnectBackoffMax + "ms")
+	if nil != err {
+		log.DefaultLogger.Debug("Using default maximum reconnect backoff")
+		reconnectBackoffMax = defaultReconnectBackoffMax
+	}
+	client.reconnectBackoffMax = reconnectBackoffMax
+	log.DefaultLogger.Info("Making handle pools")
+	client.setupEndpoints(client.PoolMinSize, client.PoolMaxSize, poolIdleTimeout)
+	failbackInterval, err := time.ParseDuration(client.FailbackInterval + "ms")
+	if nil != err {
+		log.DefaultLogger.Debug("Using default failback interval")
+		failbackInterval = defaultFailbackInterval
+	}
+	client.failbackInterval = failbackInterval
 
-	// make channel for synchronous responses
-	log.DefaultLogger.Info("Making synchronous response channel")
-	client.syncResChan = make(chan *kdbSyncRes)
+	if client.MaxConcurrentQueries < 1 {
+		log.DefaultLogger.Debug("Using pool max size as maximum concurrent queries")
+		client.MaxConcurrentQueries = client.Endpoints[0].pool.maxSize
+	}
 
 	// making signals channel
 	log.DefaultLogger.Info("Making signals channel")
 	client.signals = make(chan int)
 
-	// start synchronous query listener
-	go client.syncQueryRunner()
+	// start synchronous query listeners for the minimum number of pooled handles; when failing over
+	// the pools for endpoints other than the primary are only filled on failover
+	for i, e := range client.Endpoints {
+		if i > 0 && !client.isLoadBalanced() {
+			break
+		}
+		for j := 0; j < e.pool.minSize; j++ {
+			client.growPool(e.pool)
+		}
+	}
+	if len(client.Endpoints) > 1 {
+		go client.endpointProbeRunner()
+	}
 
 	log.DefaultLogger.Info("KDB Datasource created successfully")
 	return &client, nil
@@ -179,75 +301,112 @@ func NewKdbDatasource(settings backend.DataSourceInstanceSettings) (instancemgmt
 
 func (d *KdbDatasource) Dispose() {
 	log.DefaultLogger.Debug("Dispose called")
-	if d.IsOpen {
-		log.DefaultLogger.Debug("Handle open when dispose called, closing handle")
-		err := d.CloseConnection()
-		if err != nil {
-			log.DefaultLogger.Error("Error closing KDB connection", err)
-		}
-	}
-	d.signals <- 3
+	// closing the signals channel stops every query runner, each of which closes its own handle
 	close(d.signals)
-	close(d.syncQueue)
-	close(d.syncResChan)
 }
 
-func (d *KdbDatasource) openConnection() error {
-	log.DefaultLogger.Info(fmt.Sprintf("Opening connection to %s:%v ...", d.Host, d.Port))
-	auth := fmt.Sprintf("%s:%s", d.user, d.pass)
-	var conn *kdb.KDBConn = nil
+func (d *KdbDatasource) openConnection(h *kdbHandle) error {
+	e := h.pool.endpoint
+	log.DefaultLogger.Info(fmt.Sprintf("Opening connection to %v ...", e))
+	auth := d.credentials(h.pool)
+	var conn kdbConn = nil
 	var err error
-	if d.WithTls {
-		conn, err = kdb.DialTLS(d.Host, d.Port, auth, d.TlsServerConfig)
-	} else {
-		conn, err = kdb.DialKDBTimeout(d.Host, d.Port, auth, d.DialTimeout)
+	switch {
+	case d.ConnectionMode == connectionModeUnix:
+		conn, err = dialKdbSocket("unix", e.socketPath(), auth, d.DialTimeout, 0, nil)
+	case d.WithTls:
+		conn, err = dialKdbSocket("tcp", net.JoinHostPort(e.Host, strconv.Itoa(e.Port)), auth, d.DialTimeout, d.tcpKeepAlive, d.TlsServerConfig)
+	default:
+		conn, err = dialKdbSocket("tcp", net.JoinHostPort(e.Host, strconv.Itoa(e.Port)), auth, d.DialTimeout, d.tcpKeepAlive, nil)
 	}
 	if err != nil {
 		log.DefaultLogger.Error(fmt.Sprintf("Error establishing kdb connection - %s", err.Error()))
-		d.KdbHandle = nil
+		h.conn = nil
 		return err
 	}
-	log.DefaultLogger.Info(fmt.Sprintf("Dialled %s:%v successfully", d.Host, d.Port))
-	d.KdbHandle = conn
-	d.IsOpen = true
+	log.DefaultLogger.Info(fmt.Sprintf("Dialled %v successfully (handle %v)", e, h.id))
+	h.conn = conn
+	h.setOpen()
 
-	// making raw read channel
+	// making raw read channel; it is buffered so that the listener can always publish a dropped connection
+	// and return, even if the handle is idle
 	log.DefaultLogger.Debug("Making raw response channel")
-	d.rawReadChan = make(chan *kdbRawRead)
+	h.rawReadChan = make(chan *kdbRawRead, 1)
 
 	// start synchronous handle reader
 	log.DefaultLogger.Debug("Beginning handle listener")
-	go d.KdbHandleListener()
+	listenerEnd := make(chan struct{})
+	h.listenerEnd = listenerEnd
+	go func() {
+		defer close(listenerEnd)
+		d.KdbHandleListener(h)
+	}()
 	return nil
 }
 
-func (d *KdbDatasource) closeConnection() error {
-	if !d.IsOpen {
-		log.DefaultLogger.Debug(fmt.Sprintf("Connection to %s:%v already closed (hint: potentially closed at remote end?)", d.Host, d.Port))
-		close(d.rawReadChan)
+func (d *KdbDatasource) closeConnection(h *kdbHandle) error {
+	e := h.pool.endpoint
+	// mark the handle closed first so the listener does not publish the resulting read error
+	if !h.markClosed() {
+		log.DefaultLogger.Debug(fmt.Sprintf("Connection to %v already closed (hint: potentially closed at remote end?)", e))
+		// the listener marks a connection dropped by kdb+ as closed, but the socket is still ours to close
+		if h.conn != nil {
+			h.conn.Close()
+			h.conn = nil
+		}
+		h.awaitListener(d.DialTimeout)
 		return nil
 	}
-	log.DefaultLogger.Info(fmt.Sprintf("Closing connection to %s:%v ...", d.Host, d.Port))
-	err := d.KdbHandle.Close()
+	log.DefaultLogger.Info(fmt.Sprintf("Closing connection %v to %v ...", h.id, e))
+	err := h.conn.Close()
 	if err != nil {
-		log.DefaultLogger.Error(fmt.Sprintf("Error closing handle to %s:%v ...", d.Host, d.Port))
+		log.DefaultLogger.Error(fmt.Sprintf("Error closing handle to %v ...", e))
 	}
-	d.IsOpen = false
-	close(d.rawReadChan)
+	h.awaitListener(d.DialTimeout)
+	h.conn = nil
+	h.failPending(fmt.Errorf("Handle to %v closed with query in flight", e))
 	return err
 }
 
 func (d *KdbDatasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
 	response := backend.NewQueryDataResponse()
+	maxConcurrency := d.MaxConcurrentQueries
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
 
+	// run up to maxConcurrency queries at once, each writing only its own RefID's response
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	sem := make(chan struct{}, maxConcurrency)
 	for _, q := range req.Queries {
-		res := d.query(ctx, req.PluginContext, q)
-		response.Responses[q.RefID] = res
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(q backend.DataQuery) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res := d.safeQuery(ctx, req.PluginContext, q)
+			lock.Lock()
+			response.Responses[q.RefID] = res
+			lock.Unlock()
+		}(q)
 	}
+	wg.Wait()
 	return response, nil
 }
 
-func (d *KdbDatasource) query(_ context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
+// safeQuery runs query, converting any panic into an error on that query's response alone
+func (d *KdbDatasource) safeQuery(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) (response backend.DataResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.DefaultLogger.Error(fmt.Sprintf("Panic while running query %v: %v", query.RefID, r))
+			response = backend.DataResponse{Error: fmt.Errorf("Internal error running query: %v", r)}
+		}
+	}()
+	return d.query(ctx, pCtx, query)
+}
+
+func (d *KdbDatasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
 	var MyQuery QueryModel
 	response := backend.DataResponse{}
 	err := json.Unmarshal(query.JSON, &MyQuery)
@@ -259,9 +418,61 @@ func (d *KdbDatasource) query(_ context.Context, pCtx backend.PluginContext, que
 	if MyQuery.Timeout < 1 {
 		MyQuery.Timeout = 10000
 	}
+	if query.QueryType == queryTypeStream {
+		frame, err := d.streamFrame(pCtx, query, MyQuery)
+		if err != nil {
+			response.Error = err
+			return response
+		}
+		response.Frames = append(response.Frames, frame)
+		return response
+	}
 	userDict := buildUserKdbDict(pCtx.User)
 	datasourceDict := buildDatasourceKdbDict(pCtx.DataSourceInstanceSettings)
-	queryDict := buildQueryKdbDict(query, MyQuery.QueryText)
+	variablesDict, err := buildVariablesKdbDict(MyQuery.Variables)
+	if err != nil {
+		response.Error = err
+		return response
+	}
+	filtersTable, err := buildFiltersKdbTable(MyQuery.AdhocFilters)
+	if err != nil {
+		response.Error = err
+		return response
+	}
+	var queryDict *kdb.K
+	var queryText string
+	switch MyQuery.QueryMode {
+	case queryModeFunction:
+		call, err := buildFunctionCall(MyQuery.Function, MyQuery.Arguments)
+		if err != nil {
+			response.Error = err
+			return response
+		}
+		queryDict = buildQueryKdbDict(query, call, "FUNCTION", variablesDict, filtersTable)
+	case queryModeBuilder:
+		sel, err := compileBuilderQuery(MyQuery.Builder, query)
+		if err != nil {
+			response.Error = err
+			return response
+		}
+		queryDict = buildQueryKdbDict(query, sel, "BUILDER", variablesDict, filtersTable)
+		// bucketed times are the time axis, whichever column is leftmost
+		if MyQuery.Builder.TimeBucket {
+			MyQuery.UseTimeColumn = true
+			MyQuery.TimeColumn = MyQuery.Builder.TimeColumn
+		}
+	case "", queryModeText:
+		text, err := expandMacros(MyQuery.QueryText, query)
+		if err != nil {
+			response.Error = err
+			return response
+		}
+		queryText = text
+		queryDict = buildQueryKdbDict(query, kdb.Atom(kdb.KC, text), "QUERY", variablesDict, filtersTable)
+	default:
+		response.Error = fmt.Errorf("Unsupported query mode '%v'", MyQuery.QueryMode)
+		return response
+	}
 	masterKeys := kdb.SymbolV([]string{"AQUAQ_KDB_BACKEND_GRAF_DATASOURCE", "Time", "OrgID", "Datasource", "User", "Query", "Timeout"})
 	masterValues := kdb.NewList(
 		kdb.Float(ADAPTOR_VERSION),
@@ -272,11 +483,54 @@ func (d *KdbDatasource) query(_ context.Context, pCtx backend.PluginContext, que
 		queryDict,
 		kdb.Long(int64(MyQuery.Timeout)))
 
-	kdbResponse, err := d.RunKdbQuerySync(kdb.NewList(kdb.Atom(kdb.KC, "{[x] value x[`Query;`Query]}"), kdb.NewDict(masterKeys, masterValues)), time.Duration(MyQuery.Timeout)*time.Millisecond)
+	ctx, err = d.userContext(ctx, pCtx.User)
+	if err != nil {
+		response.Error = err
+		return response
+	}
+	// refuse text queries which do not parse rather than have kdb+ run them
+	if d.ValidateQueries && queryText != "" {
+		parsed, err := d.parseQuery(ctx, pCtx, queryText)
+		if err != nil {
+			response.Error = fmt.Errorf("Error checking query syntax: %v", err)
+			return response
+		}
+		if !parsed.Valid {
+			response.Error = fmt.Errorf("Query failed to parse: %v", parsed.Error)
+			return response
+		}
+	}
+	kdbResponse, err := d.RunKdbQuerySync(ctx, kdb.NewList(d.entryFunction(), kdb.NewDict(masterKeys, masterValues)), time.Duration(MyQuery.Timeout)*time.Millisecond)
 	if err != nil {
 		response.Error = err
 		return response
 	}
+	if MyQuery.QueryMode == queryModeBuilder && MyQuery.Builder.unkeysResult() {
+		kdbResponse = unkeyKdbTable(kdbResponse)
+	}
+
+	// annotation and log tables are converted to the frames Grafana expects of them
+	timeColumn := ""
+	if MyQuery.UseTimeColumn {
+		timeColumn = MyQuery.TimeColumn
+	}
+	switch query.QueryType {
+	case queryTypeAnnotation:
+		frame, err := ParseAnnotationKdbTable(kdbResponse, timeColumn)
+		if err != nil {
+			response.Error = err
+			return response
+		}
+		frame.Name = query.RefID
+		response.Frames = append(response.Frames, frame)
+		return response
+	case queryTypeLogs:
+		response.Frames, response.Error = ParseLogsKdbTable(kdbResponse, MyQuery.Logs, timeColumn)
+		return response
+	case queryTypeLogVolume:
+		response.Frames, response.Error = ParseLogVolumeKdbTable(kdbResponse, MyQuery.Logs, timeColumn, query)
+		return response
+	}
 
 	// Parse response data
 	switch {
@@ -321,24 +575,16 @@ func (d *KdbDatasource) query(_ context.Context, pCtx backend.PluginContext, que
 	return response
 }
 
-func (d *KdbDatasource) CheckHealth(_ context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	userDict := buildUserKdbDict(req.PluginContext.User)
-	datasourceDict := buildDatasourceKdbDict(req.PluginContext.DataSourceInstanceSettings)
-	k := kdb.SymbolV([]string{"AQUAQ_KDB_BACKEND_GRAF_DATASOURCE", "Time", "OrgID", "Datasource", "User", "Query", "Timeout"})
-	v := kdb.NewList(
-		kdb.Float(ADAPTOR_VERSION),
-		kdb.Atom(-kdb.KP, time.Now()),
-		kdb.Long(req.PluginContext.OrgID),
-		datasourceDict,
-		userDict,
-		kdb.NewDict(kdb.SymbolV([]string{"Query", "QueryType"}), kdb.NewList(kdb.Atom(kdb.KC, "1+1"), kdb.Symbol("HEALTHCHECK"))),
-		kdb.Long(int64(d.DialTimeout)))
-
-	test, err := d.RunKdbQuerySync(kdb.NewList(kdb.Atom(kdb.KC, "{[x] value x[`Query;`Query]}"), kdb.NewDict(k, v)), d.DialTimeout)
+func (d *KdbDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	ctx, err := d.userContext(ctx, req.PluginContext.User)
+	if err != nil {
+		return &backend.CheckHealthResult{Status: backend.HealthStatusError, Message: err.Error()}, nil
+	}
+	test, err := d.RunKdbQuerySync(ctx, buildHealthCheckKdbQuery(d.healthCheckFunction(), req.PluginContext, d.DialTimeout), d.DialTimeout)
 	if err != nil {
 		log.DefaultLogger.Error("CheckHealth error: %v", err)
 		emsg := fmt.Sprintf("Error querying kdb+ process: %v", err)
-		if err == io.EOF {
+		if errors.Is(err, io.EOF) {
 			emsg += " (hint: potential authentication error)"
 		}
 		return &backend.CheckHealthResult{Status: backend.HealthStatusError, Message: emsg}, nil
@@ -362,6 +608,11 @@ func (d *KdbDatasource) CheckHealth(_ context.Context, req *backend.CheckHealthR
 	if val == 2 {
 		status = backend.HealthStatusOk
 		message = "kdb+ connected succesfully"
+		if d.isLoadBalanced() {
+			message += fmt.Sprintf(" (healthy endpoints %v)", d.getHealthyEndpoints())
+		} else if e := d.getActiveEndpoint(); e != nil {
+			message += fmt.Sprintf(" (active endpoint %v)", e)
+		}
 
 	} else {
 		status = backend.HealthStatusError
@@ -1,16 +1,26 @@
 package plugin
 
 import (
+	"bufio"
+	"context"
 	"encoding/csv"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	kdb "github.com/sv/kdbgo"
 )
 
@@ -70,10 +80,10 @@ type testServer struct {
 	auto bool
 }
 
-func getConfigAndInit() (*KdbDatasource, *testServer, error) {
+func getConfigAndInit() (*KdbDatasource, *kdbHandle, *testServer, error) {
 	cfg, err := getConfig()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	ds := &KdbDatasource{}
 	testSrv := &testServer{}
@@ -87,7 +97,7 @@ func getConfigAndInit() (*KdbDatasource, *testServer, error) {
 		}
 		err = cmd.Start()
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		testSrv.cmd = cmd
 	}
@@ -98,23 +108,21 @@ func getConfigAndInit() (*KdbDatasource, *testServer, error) {
 	ds.DialTimeout = time.Duration(time.Second * 5)
 	ds.WithTls = false
 	ds.setupKdbConnectionHandlers()
-	return ds, testSrv, err
+	ds.setupEndpoints(1, 1, time.Minute)
+	h, _ := ds.Endpoints[0].pool.reserve()
+	return ds, h, testSrv, err
 }
 
-func cleanup(ds *KdbDatasource, testSrv *testServer) {
-	ds.KdbHandle.Close()
-	if ds.rawReadChan != nil {
-		close(ds.rawReadChan)
+func cleanup(ds *KdbDatasource, h *kdbHandle, testSrv *testServer) {
+	if h.conn != nil {
+		h.conn.Close()
+	}
+	if h.rawReadChan != nil && h.IsOpen() {
+		close(h.rawReadChan)
 	}
 	if ds.signals != nil {
 		close(ds.signals)
 	}
-	if ds.syncQueue != nil {
-		close(ds.syncQueue)
-	}
-	if ds.syncResChan != nil {
-		close(ds.syncResChan)
-	}
 	if testSrv.auto {
 		testSrv.cmd.Process.Kill()
 	}
@@ -123,16 +131,16 @@ func cleanup(ds *KdbDatasource, testSrv *testServer) {
 
 func TestOpenConnectionStd(t *testing.T) {
 	// Init
-	ds, testSrv, err := getConfigAndInit()
+	ds, h, testSrv, err := getConfigAndInit()
 	if err != nil {
 		t.Errorf("Error loading config: %v", err)
 		return
 	}
 	t.Logf("kdb+ test server: %s:%v:%s:%s", ds.Host, ds.Port, ds.user, ds.pass)
 	t.Logf("Mocking KdbHandleListener function...")
-	ds.KdbHandleListener = func() {}
+	ds.KdbHandleListener = func(*kdbHandle) {}
 
-	err = ds.openConnection()
+	err = ds.openConnection(h)
 	if err != nil {
 		t.Errorf("Error opening connection: %v", err)
 		return
@@ -140,42 +148,42 @@ func TestOpenConnectionStd(t *testing.T) {
 
 	// Cleanup
 	t.Logf("Finished test, cleaning up...")
-	cleanup(ds, testSrv)
+	cleanup(ds, h, testSrv)
 	t.Logf("Cleaned up kdb+ test server")
 }
 
 func TestCloseConnection(t *testing.T) {
 	// Init
-	ds, testSrv, err := getConfigAndInit()
+	ds, h, testSrv, err := getConfigAndInit()
 	if err != nil {
 		t.Errorf("Error loading config: %v", err)
 		return
 	}
 	t.Logf("kdb+ test server: %s:%v:%s:%s", ds.Host, ds.Port, ds.user, ds.pass)
 	t.Logf("Mocking KdbHandleListener function...")
-	ds.KdbHandleListener = func() {}
+	ds.KdbHandleListener = func(*kdbHandle) {}
 
-	err = ds.openConnection()
+	err = ds.openConnection(h)
 	if err != nil {
 		t.Errorf("Error opening connection: %v", err)
 		return
 	}
-	if !ds.IsOpen {
+	if !h.IsOpen() {
 		t.Errorf("Connection is not assigned as open in KdbDatasource object after calling openConnection")
-		cleanup(ds, testSrv)
+		cleanup(ds, h, testSrv)
 		return
 	}
 
-	err = ds.closeConnection()
+	err = ds.closeConnection(h)
 	if err != nil {
 		t.Errorf("Error calling closeConnection: %v", err)
-		cleanup(ds, testSrv)
+		cleanup(ds, h, testSrv)
 		return
 	}
-	if ds.IsOpen {
+	if h.IsOpen() {
 		t.Errorf("Connection is assigned as open in KdbDatasource object after calling closeConnection")
 	}
-	cleanup(ds, testSrv)
+	cleanup(ds, h, testSrv)
 	return
 }
 
@@ -183,15 +191,16 @@ func TestKdbHandleListenerResponses(t *testing.T) {
 	// Init
 	ds := &KdbDatasource{}
 	ds.setupKdbConnectionHandlers()
+	h := &kdbHandle{}
 	// Set handle assignment as open
-	ds.IsOpen = true
+	h.setOpen()
 	// create raw results channel
-	ds.rawReadChan = make(chan *kdbRawRead)
+	h.rawReadChan = make(chan *kdbRawRead)
 	// Make mock readConnection objects and function to use during tests
 	mockKdbObj := kdb.Long(21)
 	mockErr := kdb.Error(fmt.Errorf("KDB ERROR"))
 	testCounter := 0
-	mockReaderFunc := func() (*kdb.K, kdb.ReqType, error) {
+	mockReaderFunc := func(*kdbHandle) (*kdb.K, kdb.ReqType, error) {
 		switch testCounter {
 		case 0:
 			testCounter += 1
@@ -205,48 +214,48 @@ func TestKdbHandleListenerResponses(t *testing.T) {
 
 	// Start listener test
 	ds.ReadConnection = mockReaderFunc
-	go ds.kdbHandleListener()
+	go ds.kdbHandleListener(h)
 	// Test standard kdb+ object return
-	res := <-ds.rawReadChan
+	res := <-h.rawReadChan
 	if res.err != nil {
 		t.Errorf("Standard kdb+ object read failed: %v", res.err)
 		testCounter = 3
-		res = <-ds.rawReadChan
-		close(ds.rawReadChan)
+		res = <-h.rawReadChan
+		close(h.rawReadChan)
 		return
 	}
 	if res.result != mockKdbObj {
 		t.Errorf("Standard kdb+ object read not as expected: %v", res.result)
 		testCounter = 3
-		res = <-ds.rawReadChan
-		close(ds.rawReadChan)
+		res = <-h.rawReadChan
+		close(h.rawReadChan)
 		return
 	}
 	t.Logf("Standard kdb+ object read successful")
 
 	// Test error kdb+ object return
-	res = <-ds.rawReadChan
+	res = <-h.rawReadChan
 	if res.err != nil {
 		t.Errorf("Error kdb+ object read failed: %v", res.err)
 		testCounter = 3
-		res = <-ds.rawReadChan
-		close(ds.rawReadChan)
+		res = <-h.rawReadChan
+		close(h.rawReadChan)
 		return
 	}
 	if res.result != mockErr {
 		t.Errorf("Error kdb+ object read not as expected: %v", res.result)
 		testCounter = 3
-		res = <-ds.rawReadChan
-		close(ds.rawReadChan)
+		res = <-h.rawReadChan
+		close(h.rawReadChan)
 		return
 	}
 	t.Logf("Error kdb+ object read successful")
 
 	// Close goroutine and channel
-	res = <-ds.rawReadChan
+	res = <-h.rawReadChan
 	if res.err == nil {
 		t.Logf("EOF kdb+ object read did not throw error as expected, subsequent tests may fail")
-		close(ds.rawReadChan)
+		close(h.rawReadChan)
 		return
 	}
 	t.Logf("Closed goroutine successfully")
@@ -256,90 +265,1962 @@ func TestKdbHandleListenerClose(t *testing.T) {
 	// Init
 	ds := &KdbDatasource{}
 	ds.setupKdbConnectionHandlers()
+	h := &kdbHandle{}
 	// Set handle assignment as open
-	ds.IsOpen = true
+	h.setOpen()
 	// create raw results channel
-	ds.rawReadChan = make(chan *kdbRawRead)
+	h.rawReadChan = make(chan *kdbRawRead)
 	hardErr := fmt.Errorf("Failed to read message header:EOF")
-	returnEOF := func() (*kdb.K, kdb.ReqType, error) { return nil, -1, hardErr }
+	returnEOF := func(*kdbHandle) (*kdb.K, kdb.ReqType, error) { return nil, -1, hardErr }
 
 	ds.ReadConnection = returnEOF
-	go ds.kdbHandleListener()
-	res := <-ds.rawReadChan
+	go ds.kdbHandleListener(h)
+	res := <-h.rawReadChan
 	if res.err == nil {
 		t.Errorf("No error returned to raw read channel after bad read")
 		return
 	}
-	if ds.IsOpen == true {
+	if h.IsOpen() {
 		t.Errorf("Handle not assigned as closed after bad read")
 		return
 	}
 	t.Logf("Bad read handled successfully")
 }
 
-func TestCheckHealthSuccess(t *testing.T) {
-	// Init
+func mockPooledDatasource(minSize int, maxSize int, idleTimeout time.Duration, queryTime time.Duration) (*KdbDatasource, *int32) {
 	ds := &KdbDatasource{}
 	ds.setupKdbConnectionHandlers()
-	// Set handle assignment as open
-	ds.IsOpen = true
-	ds.RunKdbQuerySync = func(*kdb.K, time.Duration) (*kdb.K, error) { return kdb.Long(2), nil }
-	res, err := ds.CheckHealth(nil, nil)
+	ds.signals = make(chan int)
+	ds.setupEndpoints(minSize, maxSize, idleTimeout)
+	var opened int32
+	ds.OpenConnection = func(h *kdbHandle) error {
+		atomic.AddInt32(&opened, 1)
+		h.setOpen()
+		h.rawReadChan = make(chan *kdbRawRead)
+		return nil
+	}
+	ds.CloseConnection = func(h *kdbHandle) error {
+		h.markClosed()
+		return nil
+	}
+	ds.WriteConnection = func(h *kdbHandle, _ kdb.ReqType, q *kdb.K) error {
+		go func() {
+			time.Sleep(queryTime)
+			h.rawReadChan <- &kdbRawRead{result: q, err: nil}
+		}()
+		return nil
+	}
+	return ds, &opened
+}
+
+func TestPoolRunsQueriesConcurrently(t *testing.T) {
+	ds, opened := mockPooledDatasource(1, 2, time.Minute, 200*time.Millisecond)
+	defer close(ds.signals)
+	ds.growPool(ds.Endpoints[0].pool)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := ds.runKdbQuerySync(context.Background(), kdb.Long(int64(i)), time.Second)
+			if err != nil {
+				t.Errorf("Error running pooled query: %v", err)
+				return
+			}
+			if res.Data.(int64) != int64(i) {
+				t.Errorf("Pooled query %v received response for another query: %v", i, res.Data)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 390*time.Millisecond {
+		t.Errorf("Pooled queries ran serially, took %v", elapsed)
+	}
+	if ds.Endpoints[0].pool.Size() != 2 || atomic.LoadInt32(opened) != 2 {
+		t.Errorf("Expected pool to grow to 2 handles, size is %v with %v opened", ds.Endpoints[0].pool.Size(), atomic.LoadInt32(opened))
+	}
+}
+
+func TestPoolShrinksWhenIdle(t *testing.T) {
+	ds, _ := mockPooledDatasource(1, 3, 50*time.Millisecond, 100*time.Millisecond)
+	defer close(ds.signals)
+	ds.growPool(ds.Endpoints[0].pool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ds.runKdbQuerySync(context.Background(), kdb.Long(1), time.Second)
+		}()
+	}
+	wg.Wait()
+	if ds.Endpoints[0].pool.Size() != 3 {
+		t.Errorf("Expected pool to grow to 3 handles, size is %v", ds.Endpoints[0].pool.Size())
+	}
+	time.Sleep(300 * time.Millisecond)
+	if ds.Endpoints[0].pool.Size() != 1 {
+		t.Errorf("Expected idle pool to shrink to its minimum size of 1, size is %v", ds.Endpoints[0].pool.Size())
+	}
+}
+
+func TestCancelInFlightQuery(t *testing.T) {
+	ds, _ := mockPooledDatasource(1, 1, time.Minute, 200*time.Millisecond)
+	defer close(ds.signals)
+	ds.growPool(ds.Endpoints[0].pool)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := ds.runKdbQuerySync(ctx, kdb.Long(1), time.Second)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected cancelled query to return context error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("Cancelled query did not return promptly, took %v", elapsed)
+	}
+
+	// The reply to the abandoned query must not be delivered to the next query on the handle
+	res, err := ds.runKdbQuerySync(context.Background(), kdb.Long(2), time.Second)
 	if err != nil {
-		t.Errorf("Error running CheckHealth: %v", err)
+		t.Errorf("Error running query after cancellation: %v", err)
 		return
 	}
-	if res.Status != backend.HealthStatusOk {
-		t.Errorf("Successful CheckHealth did not return OK health status")
-		return
+	if res.Data.(int64) != 2 {
+		t.Errorf("Query after cancellation received stale response: %v", res.Data)
 	}
 }
 
-func TestCheckHealthFailValue(t *testing.T) {
-	// Init
+func TestCancelQueuedQuery(t *testing.T) {
+	ds, _ := mockPooledDatasource(1, 1, time.Minute, 200*time.Millisecond)
+	defer close(ds.signals)
+	var written int32
+	mockWrite := ds.WriteConnection
+	ds.WriteConnection = func(h *kdbHandle, msgtype kdb.ReqType, q *kdb.K) error {
+		atomic.AddInt32(&written, 1)
+		return mockWrite(h, msgtype, q)
+	}
+	ds.growPool(ds.Endpoints[0].pool)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ds.runKdbQuerySync(context.Background(), kdb.Long(1), time.Second)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := ds.runKdbQuerySync(ctx, kdb.Long(2), time.Second)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected queued query to return context error, got: %v", err)
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&written) != 1 {
+		t.Errorf("Cancelled queued query was sent to kdb+")
+	}
+}
+
+func TestQueryDataConcurrent(t *testing.T) {
 	ds := &KdbDatasource{}
 	ds.setupKdbConnectionHandlers()
-	// Set handle assignment as open
-	ds.IsOpen = true
-	ds.RunKdbQuerySync = func(*kdb.K, time.Duration) (*kdb.K, error) { return kdb.Long(3), nil }
-	res, err := ds.CheckHealth(nil, nil)
+	ds.MaxConcurrentQueries = 4
+	var running, maxRunning int32
+	ds.RunKdbQuerySync = func(context.Context, *kdb.K, time.Duration) (*kdb.K, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		return kdb.NewTable([]string{"x"}, []*kdb.K{kdb.LongV([]int64{1, 2})}), nil
+	}
+	queries := []backend.DataQuery{}
+	for _, refID := range []string{"A", "B", "C", "D", "E", "F"} {
+		queries = append(queries, backend.DataQuery{RefID: refID, JSON: []byte(`{"queryText":"x"}`)})
+	}
+	queries = append(queries, backend.DataQuery{RefID: "G", JSON: []byte(`not json`)})
+
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
 	if err != nil {
-		t.Errorf("Error running CheckHealth: %v", err)
+		t.Errorf("Error running QueryData: %v", err)
 		return
 	}
-	if res.Status != backend.HealthStatusError {
-		t.Errorf("Erroring CheckHealth did not return Error health status")
+	if maxRunning > 4 {
+		t.Errorf("QueryData exceeded max concurrency, ran %v queries at once", maxRunning)
+	}
+	if maxRunning < 2 {
+		t.Errorf("QueryData did not run queries concurrently")
+	}
+	if len(resp.Responses) != len(queries) {
+		t.Errorf("Expected %v responses, got %v", len(queries), len(resp.Responses))
+	}
+	for _, refID := range []string{"A", "B", "C", "D", "E", "F"} {
+		res := resp.Responses[refID]
+		if res.Error != nil || len(res.Frames) != 1 || res.Frames[0].Name != refID {
+			t.Errorf("Unexpected response for query %v: %v", refID, res)
+		}
+	}
+	if resp.Responses["G"].Error == nil {
+		t.Errorf("Error in query G not returned in its response")
+	}
+}
+
+func mockAsyncDatasource(queryTime time.Duration) *KdbDatasource {
+	ds := &KdbDatasource{AsyncQueries: true}
+	ds.setupKdbConnectionHandlers()
+	ds.signals = make(chan int)
+	ds.setupEndpoints(1, 1, time.Minute)
+	replies := make(chan *kdb.K)
+	ds.OpenConnection = func(h *kdbHandle) error {
+		h.setOpen()
+		h.rawReadChan = make(chan *kdbRawRead)
+		go ds.KdbHandleListener(h)
+		return nil
+	}
+	ds.CloseConnection = func(h *kdbHandle) error {
+		h.markClosed()
+		h.failPending(fmt.Errorf("closed"))
+		return nil
+	}
+	ds.ReadConnection = func(*kdbHandle) (*kdb.K, kdb.ReqType, error) {
+		return <-replies, kdb.ASYNC, nil
+	}
+	// echo back the query's Query entry, or an error if it is the string "error"
+	ds.WriteConnection = func(h *kdbHandle, msgtype kdb.ReqType, q *kdb.K) error {
+		if msgtype != kdb.ASYNC {
+			return fmt.Errorf("Expected async message")
+		}
+		dict := q.Data.([]*kdb.K)[2].Data.(kdb.Dict)
+		var id, payload *kdb.K
+		for i, k := range dict.Key.Data.([]string) {
+			switch k {
+			case "CorrelationID":
+				id = dict.Value.Data.([]*kdb.K)[i]
+			case "Query":
+				payload = dict.Value.Data.([]*kdb.K)[i]
+			}
+		}
+		go func() {
+			time.Sleep(queryTime)
+			if payload.Type == kdb.KC && payload.Data.(string) == "error" {
+				replies <- kdb.NewList(id, kdb.Atom(-kdb.KB, true), kdb.Atom(kdb.KC, "type"))
+				return
+			}
+			replies <- kdb.NewList(id, kdb.Atom(-kdb.KB, false), payload)
+		}()
+		return nil
+	}
+	return ds
+}
+
+func TestAsyncQueriesMultiplexed(t *testing.T) {
+	ds := mockAsyncDatasource(200 * time.Millisecond)
+	defer close(ds.signals)
+	ds.growPool(ds.Endpoints[0].pool)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := kdb.NewList(kdb.Atom(kdb.KC, "{x}"), kdb.NewDict(kdb.SymbolV([]string{"Query"}), kdb.NewList(kdb.Long(int64(i)))))
+			res, err := ds.runKdbQuerySync(context.Background(), q, time.Second)
+			if err != nil {
+				t.Errorf("Error running async query: %v", err)
+				return
+			}
+			if res.Data.(int64) != int64(i) {
+				t.Errorf("Async query %v received response for another query: %v", i, res.Data)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 390*time.Millisecond {
+		t.Errorf("Async queries were not in flight together, took %v", elapsed)
+	}
+	if ds.Endpoints[0].pool.Size() != 1 {
+		t.Errorf("Async queries should share a single handle, pool size is %v", ds.Endpoints[0].pool.Size())
+	}
+
+	q := kdb.NewList(kdb.Atom(kdb.KC, "{x}"), kdb.NewDict(kdb.SymbolV([]string{"Query"}), kdb.NewList(kdb.Atom(kdb.KC, "error"))))
+	_, err := ds.runKdbQuerySync(context.Background(), q, time.Second)
+	if err == nil || err.Error() != "type" {
+		t.Errorf("Expected kdb+ error from async query, got: %v", err)
+	}
+}
+
+func TestEndpointFailoverAndFailback(t *testing.T) {
+	ds := &KdbDatasource{Endpoints: []*kdbEndpoint{{Host: "primary", Port: 1}, {Host: "secondary", Port: 2}}}
+	ds.setupKdbConnectionHandlers()
+	ds.signals = make(chan int)
+	defer close(ds.signals)
+	ds.reconnectBackoffMin = 10 * time.Millisecond
+	ds.reconnectBackoffMax = 20 * time.Millisecond
+	ds.setupEndpoints(1, 1, time.Minute)
+	ds.DialTimeout = time.Second
+	ds.failbackInterval = 50 * time.Millisecond
+	var primaryUp int32
+	ds.OpenConnection = func(h *kdbHandle) error {
+		if h.pool.endpoint.Host == "primary" && atomic.LoadInt32(&primaryUp) == 0 {
+			return fmt.Errorf("connection refused")
+		}
+		h.setOpen()
+		h.rawReadChan = make(chan *kdbRawRead)
+		return nil
+	}
+	ds.CloseConnection = func(h *kdbHandle) error {
+		h.markClosed()
+		return nil
+	}
+	ds.WriteConnection = func(h *kdbHandle, _ kdb.ReqType, _ *kdb.K) error {
+		go func() { h.rawReadChan <- &kdbRawRead{result: kdb.Long(2), err: nil} }()
+		return nil
+	}
+
+	res, err := ds.runKdbQuerySync(context.Background(), kdb.Long(1), time.Second)
+	if err != nil || res.Data.(int64) != 2 {
+		t.Errorf("Query did not fail over to secondary endpoint: %v, %v", res, err)
 		return
 	}
+	if ds.getActiveEndpoint().Host != "secondary" {
+		t.Errorf("Active endpoint not updated after failover: %v", ds.getActiveEndpoint())
+	}
+
+	go ds.endpointProbeRunner()
+	time.Sleep(120 * time.Millisecond)
+	if ds.getActiveEndpoint().Host != "secondary" {
+		t.Errorf("Failed back to primary endpoint while it was unavailable")
+	}
+	atomic.StoreInt32(&primaryUp, 1)
+	time.Sleep(120 * time.Millisecond)
+	if ds.getActiveEndpoint().Host != "primary" {
+		t.Errorf("Did not fail back to primary endpoint once it was available")
+	}
 }
 
-func TestCheckHealthFailType(t *testing.T) {
-	// Init
-	ds := &KdbDatasource{}
+func TestEndpointFailoverOnEOF(t *testing.T) {
+	ds := &KdbDatasource{Endpoints: []*kdbEndpoint{{Host: "primary", Port: 1}, {Host: "secondary", Port: 2}}}
 	ds.setupKdbConnectionHandlers()
-	// Set handle assignment as open
-	ds.IsOpen = true
-	ds.RunKdbQuerySync = func(*kdb.K, time.Duration) (*kdb.K, error) {
-		return kdb.Error(fmt.Errorf("kdb+ server-side error")), nil
+	ds.signals = make(chan int)
+	defer close(ds.signals)
+	ds.setupEndpoints(1, 1, time.Minute)
+	ds.DialTimeout = time.Second
+	ds.OpenConnection = func(h *kdbHandle) error {
+		h.setOpen()
+		h.rawReadChan = make(chan *kdbRawRead)
+		return nil
 	}
-	res, err := ds.CheckHealth(nil, nil)
+	ds.CloseConnection = func(h *kdbHandle) error {
+		h.markClosed()
+		return nil
+	}
+	// the primary's pooled handle was dropped when it restarted, so the query reads EOF
+	ds.WriteConnection = func(h *kdbHandle, _ kdb.ReqType, _ *kdb.K) error {
+		if h.pool.endpoint.Host == "primary" {
+			go func() { h.rawReadChan <- &kdbRawRead{result: nil, err: fmt.Errorf(kdbEOF + "EOF")} }()
+			return nil
+		}
+		go func() { h.rawReadChan <- &kdbRawRead{result: kdb.Long(2), err: nil} }()
+		return nil
+	}
+
+	res, err := ds.runKdbQuerySync(context.Background(), kdb.Long(1), time.Second)
+	if err != nil || res.Data.(int64) != 2 {
+		t.Errorf("Query did not fail over to secondary endpoint after EOF: %v, %v", res, err)
+		return
+	}
+	if ds.getActiveEndpoint().Host != "secondary" {
+		t.Errorf("Primary endpoint not ejected after EOF: %v", ds.getActiveEndpoint())
+	}
+}
+
+func mockLoadBalancedDatasource(strategy string, queryTime time.Duration, hosts ...string) (*KdbDatasource, map[string]*int32, map[string]*int32) {
+	ds := &KdbDatasource{LoadBalancing: strategy}
+	down := make(map[string]*int32)
+	queried := make(map[string]*int32)
+	for i, host := range hosts {
+		ds.Endpoints = append(ds.Endpoints, &kdbEndpoint{Host: host, Port: i})
+		down[host] = new(int32)
+		queried[host] = new(int32)
+	}
+	ds.setupKdbConnectionHandlers()
+	ds.signals = make(chan int)
+	ds.reconnectBackoffMin = 10 * time.Millisecond
+	ds.reconnectBackoffMax = 20 * time.Millisecond
+	ds.setupEndpoints(1, 2, time.Minute)
+	ds.DialTimeout = time.Second
+	ds.failbackInterval = 50 * time.Millisecond
+	ds.OpenConnection = func(h *kdbHandle) error {
+		if atomic.LoadInt32(down[h.pool.endpoint.Host]) == 1 {
+			return fmt.Errorf("connection refused")
+		}
+		h.setOpen()
+		h.rawReadChan = make(chan *kdbRawRead)
+		return nil
+	}
+	ds.CloseConnection = func(h *kdbHandle) error {
+		h.markClosed()
+		return nil
+	}
+	ds.WriteConnection = func(h *kdbHandle, _ kdb.ReqType, _ *kdb.K) error {
+		if atomic.LoadInt32(down[h.pool.endpoint.Host]) == 1 {
+			go func() { h.rawReadChan <- &kdbRawRead{result: nil, err: fmt.Errorf(kdbEOF + "EOF")} }()
+			return nil
+		}
+		atomic.AddInt32(queried[h.pool.endpoint.Host], 1)
+		go func() {
+			time.Sleep(queryTime)
+			h.rawReadChan <- &kdbRawRead{result: kdb.Long(2), err: nil}
+		}()
+		return nil
+	}
+	return ds, down, queried
+}
+
+func TestRoundRobinWithEjection(t *testing.T) {
+	ds, down, queried := mockLoadBalancedDatasource(loadBalanceRoundRobin, 0, "a", "b", "c")
+	defer close(ds.signals)
+	for i := 0; i < 6; i++ {
+		if _, err := ds.runKdbQuerySync(context.Background(), kdb.Long(1), time.Second); err != nil {
+			t.Errorf("Error running round robin query: %v", err)
+		}
+	}
+	for host, n := range queried {
+		if atomic.LoadInt32(n) != 2 {
+			t.Errorf("Expected 2 queries to endpoint %v, got %v", host, atomic.LoadInt32(n))
+		}
+		atomic.StoreInt32(n, 0)
+	}
+
+	// take an endpoint down; it should be ejected and the other endpoints should take its share
+	atomic.StoreInt32(down["b"], 1)
+	for _, e := range ds.Endpoints {
+		if e.Host == "b" {
+			ds.ejectEndpoint(e)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		if _, err := ds.runKdbQuerySync(context.Background(), kdb.Long(1), time.Second); err != nil {
+			t.Errorf("Error running round robin query with ejected endpoint: %v", err)
+		}
+	}
+	if atomic.LoadInt32(queried["b"]) != 0 || atomic.LoadInt32(queried["a"]) != 3 || atomic.LoadInt32(queried["c"]) != 3 {
+		t.Errorf("Queries not spread over healthy endpoints: a=%v b=%v c=%v", *queried["a"], *queried["b"], *queried["c"])
+	}
+
+	// once the endpoint is back the probe should reinstate it
+	go ds.endpointProbeRunner()
+	time.Sleep(120 * time.Millisecond)
+	if len(ds.getHealthyEndpoints()) != 2 {
+		t.Errorf("Endpoint reinstated while unavailable")
+	}
+	atomic.StoreInt32(down["b"], 0)
+	time.Sleep(120 * time.Millisecond)
+	if len(ds.getHealthyEndpoints()) != 3 {
+		t.Errorf("Endpoint not reinstated once available")
+	}
+}
+
+func TestLeastOutstandingQueries(t *testing.T) {
+	ds, _, queried := mockLoadBalancedDatasource(loadBalanceLeastOutstanding, 200*time.Millisecond, "a", "b")
+	defer close(ds.signals)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ds.runKdbQuerySync(context.Background(), kdb.Long(1), time.Second)
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+	if atomic.LoadInt32(queried["a"]) != 1 || atomic.LoadInt32(queried["b"]) != 1 {
+		t.Errorf("Queries not sent to endpoint with fewest outstanding: a=%v b=%v", *queried["a"], *queried["b"])
+	}
+}
+
+func TestCircuitBreakerFastFails(t *testing.T) {
+	ds, opened := mockPooledDatasource(1, 1, time.Minute, 0)
+	defer close(ds.signals)
+	ds.Endpoints[0].breaker = newKdbBreaker(2, 100*time.Millisecond, time.Second)
+	ds.Endpoints[0].pool.breaker = ds.Endpoints[0].breaker
+	var up int32
+	mockOpen := ds.OpenConnection
+	ds.OpenConnection = func(h *kdbHandle) error {
+		if atomic.LoadInt32(&up) == 0 {
+			atomic.AddInt32(opened, 1)
+			return fmt.Errorf("connection refused")
+		}
+		return mockOpen(h)
+	}
+	ds.growPool(ds.Endpoints[0].pool)
+
+	// the initial open and one on-demand open fail, reaching the threshold and opening the breaker
+	for i := 0; i < 3; i++ {
+		ds.runKdbQuerySync(context.Background(), kdb.Long(1), time.Second)
+	}
+	attempts := atomic.LoadInt32(opened)
+	if attempts != 2 {
+		t.Errorf("Expected 2 connection attempts before breaker opened, got %v", attempts)
+	}
+	_, err := ds.runKdbQuerySync(context.Background(), kdb.Long(1), time.Second)
+	if err == nil || !strings.HasPrefix(err.Error(), "kdb+ unavailable, retrying in") {
+		t.Errorf("Expected fast-fail error while breaker open, got: %v", err)
+	}
+	if atomic.LoadInt32(opened) != attempts {
+		t.Errorf("Connection attempted while breaker open")
+	}
+
+	// once the backoff has elapsed a trial connection is allowed, closing the breaker on success
+	atomic.StoreInt32(&up, 1)
+	time.Sleep(110 * time.Millisecond)
+	res, err := ds.runKdbQuerySync(context.Background(), kdb.Long(1), time.Second)
+	if err != nil || res.Data.(int64) != 1 {
+		t.Errorf("Query failed after breaker backoff elapsed: %v", err)
+	}
+}
+
+func TestBreakerBackoffGrows(t *testing.T) {
+	b := newKdbBreaker(1, 100*time.Millisecond, 300*time.Millisecond)
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, backoff := range expected {
+		b.failure()
+		wait, open := b.isOpen()
+		if !open || wait > backoff || wait < backoff/2-10*time.Millisecond {
+			t.Errorf("Backoff after failure %v not within jitter of %v: %v", i+1, backoff, wait)
+		}
+	}
+	b.success()
+	if _, open := b.isOpen(); open {
+		t.Errorf("Breaker still open after successful connection")
+	}
+}
+
+// startMockKdbServer accepts kdb+ IPC connections on a listener, replying to each sync message with respond(msg)
+func startMockKdbServer(t *testing.T, network string, address string, respond func(*kdb.K) *kdb.K) net.Listener {
+	l, err := net.Listen(network, address)
 	if err != nil {
-		t.Errorf("Error running CheckHealth: %v", err)
+		t.Fatalf("Error starting mock kdb+ server: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				rbuf := bufio.NewReader(c)
+				if _, err := rbuf.ReadBytes(0); err != nil {
+					return
+				}
+				c.Write([]byte{3})
+				for {
+					msg, msgtype, err := kdb.Decode(rbuf)
+					if err != nil {
+						return
+					}
+					if msgtype == kdb.SYNC {
+						kdb.Encode(c, kdb.RESPONSE, respond(msg))
+					}
+				}
+			}(c)
+		}
+	}()
+	return l
+}
+
+func TestOpenConnectionUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kx.5000")
+	l := startMockKdbServer(t, "unix", path, func(*kdb.K) *kdb.K { return kdb.Long(2) })
+	defer l.Close()
+
+	ds := &KdbDatasource{Host: "ignored", Port: 5000, ConnectionMode: connectionModeUnix, SocketPath: path}
+	ds.setupKdbConnectionHandlers()
+	ds.DialTimeout = time.Second
+	ds.setupEndpoints(1, 1, time.Minute)
+	h, _ := ds.Endpoints[0].pool.reserve()
+	err := ds.openConnection(h)
+	if err != nil {
+		t.Errorf("Error opening Unix domain socket connection: %v", err)
 		return
 	}
-	if res.Status != backend.HealthStatusError {
-		t.Errorf("Erroring CheckHealth did not return Error health status")
+	defer ds.closeConnection(h)
+	if _, ok := h.conn.(*kdbSocketConn); !ok {
+		t.Errorf("Unix domain socket connection not used")
+	}
+	err = ds.WriteConnection(h, kdb.SYNC, kdb.Atom(kdb.KC, "1+1"))
+	if err != nil {
+		t.Errorf("Error writing to Unix domain socket connection: %v", err)
 		return
 	}
+	res := <-h.rawReadChan
+	if res.err != nil || res.result.Data.(int64) != 2 {
+		t.Errorf("Unexpected response over Unix domain socket: %v, %v", res.result, res.err)
+	}
 }
 
-func TestCheckHealthFailError(t *testing.T) {
-	// Init
-	ds := &KdbDatasource{}
+func TestHandshakeTimeout(t *testing.T) {
+	// a peer which accepts connections but never completes the handshake
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "kx.5001"))
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	start := time.Now()
+	_, err = dialKdbSocket("unix", l.Addr().String(), "user:pass", 100*time.Millisecond, 0, nil)
+	if err == nil {
+		t.Errorf("Expected handshake with unresponsive peer to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Handshake did not time out with the dial timeout, took %v", elapsed)
+	}
+}
+
+func TestDefaultSocketPath(t *testing.T) {
+	e := &kdbEndpoint{Host: "localhost", Port: 5000}
+	if runtime.GOOS == "linux" && e.socketPath() != "@/tmp/kx.5000" {
+		t.Errorf("Unexpected default socket path: %v", e.socketPath())
+	}
+	e.SocketPath = "/var/run/kx.sock"
+	if e.socketPath() != "/var/run/kx.sock" {
+		t.Errorf("Configured socket path not used: %v", e.socketPath())
+	}
+}
+
+func TestHeartbeatReplacesDeadHandle(t *testing.T) {
+	ds, opened := mockPooledDatasource(1, 1, time.Minute, 0)
+	defer close(ds.signals)
+	ds.DialTimeout = 20 * time.Millisecond
+	ds.heartbeatInterval = 30 * time.Millisecond
+	var dead, pings int32
+	mockWrite := ds.WriteConnection
+	ds.WriteConnection = func(h *kdbHandle, msgtype kdb.ReqType, q *kdb.K) error {
+		if q.Type == kdb.KC && q.Data.(string) == "::" {
+			atomic.AddInt32(&pings, 1)
+		}
+		if atomic.LoadInt32(&dead) == 1 {
+			return nil
+		}
+		return mockWrite(h, msgtype, q)
+	}
+	ds.growPool(ds.Endpoints[0].pool)
+
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&pings) == 0 {
+		t.Errorf("No heartbeats sent on idle handle")
+	}
+	if atomic.LoadInt32(opened) != 1 {
+		t.Errorf("Handle reconnected despite successful heartbeats")
+	}
+
+	// silently drop the connection; the next heartbeat should time out and reconnect the handle
+	atomic.StoreInt32(&dead, 1)
+	time.Sleep(100 * time.Millisecond)
+	atomic.StoreInt32(&dead, 0)
+	if atomic.LoadInt32(opened) < 2 {
+		t.Errorf("Dead handle not reconnected after failed heartbeat")
+	}
+	res, err := ds.runKdbQuerySync(context.Background(), kdb.Long(1), time.Second)
+	if err != nil || res.Data.(int64) != 1 {
+		t.Errorf("Query failed after heartbeat reconnect: %v", err)
+	}
+}
+
+func TestDroppedIdleHandleReleased(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kx.5002")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	defer l.Close()
+	// complete the handshake, then drop the first connection as a restarting kdb+ process would
+	var accepted int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(c).ReadBytes(0)
+			c.Write([]byte{3})
+			if atomic.AddInt32(&accepted, 1) == 1 {
+				c.Close()
+			} else {
+				defer c.Close()
+			}
+		}
+	}()
+
+	ds := &KdbDatasource{Port: 5002, ConnectionMode: connectionModeUnix, SocketPath: path}
 	ds.setupKdbConnectionHandlers()
-	// Set handle assignment as open
-	ds.IsOpen = true
-	ds.RunKdbQuerySync = func(*kdb.K, time.Duration) (*kdb.K, error) {
+	ds.DialTimeout = time.Second
+	ds.setupEndpoints(1, 1, time.Minute)
+	h, _ := ds.Endpoints[0].pool.reserve()
+	if err := ds.openHandle(h); err != nil {
+		t.Fatalf("Error opening handle: %v", err)
+	}
+	dropped := h.conn.(*kdbSocketConn)
+	listenerEnd := h.listenerEnd
+	select {
+	case <-listenerEnd:
+	case <-time.After(time.Second):
+		t.Fatalf("Listener did not return after the idle handle was dropped")
+	}
+	if h.IsOpen() {
+		t.Errorf("Dropped handle still marked open")
+	}
+
+	ds.heartbeat(h)
+	defer ds.closeConnection(h)
+	if !h.IsOpen() || h.conn == dropped {
+		t.Errorf("Dropped handle not reconnected by heartbeat")
+	}
+	if _, err := dropped.con.Write([]byte{0}); err == nil {
+		t.Errorf("Socket of dropped handle not closed before reconnecting")
+	}
+}
+
+func TestUserPassthroughPools(t *testing.T) {
+	ds, _ := mockPooledDatasource(1, 2, 50*time.Millisecond, 0)
+	defer close(ds.signals)
+	ds.UserPassthrough = true
+	ds.pass = "secret"
+	var authLock sync.Mutex
+	auths := map[string]bool{}
+	mockOpen := ds.OpenConnection
+	ds.OpenConnection = func(h *kdbHandle) error {
+		if h.pool.user == "mallory" {
+			return io.EOF
+		}
+		authLock.Lock()
+		auths[ds.credentials(h.pool)] = true
+		authLock.Unlock()
+		return mockOpen(h)
+	}
+
+	for _, login := range []string{"alice", "bob"} {
+		ctx, err := ds.userContext(context.Background(), &backend.User{Login: login})
+		if err != nil {
+			t.Fatalf("Error building user context: %v", err)
+		}
+		res, err := ds.runKdbQuerySync(ctx, kdb.Long(1), time.Second)
+		if err != nil || res.Data.(int64) != 1 {
+			t.Errorf("Query as %v failed: %v", login, err)
+		}
+	}
+	authLock.Lock()
+	if !auths["alice:secret"] || !auths["bob:secret"] {
+		t.Errorf("Handles not opened with each user's credentials: %v", auths)
+	}
+	authLock.Unlock()
+	if ds.Endpoints[0].pool.Size() != 0 {
+		t.Errorf("Shared pool used for passed-through users")
+	}
+
+	// a rejected user must not open the endpoint's breaker for everyone else
+	ctx, _ := ds.userContext(context.Background(), &backend.User{Login: "mallory"})
+	_, err := ds.runKdbQuerySync(ctx, kdb.Long(1), time.Second)
+	if _, ok := err.(*kdbUserRejectedError); !ok {
+		t.Errorf("Expected rejected credentials error, got: %v", err)
+	}
+	if _, open := ds.Endpoints[0].breaker.isOpen(); open {
+		t.Errorf("Rejected user opened the endpoint's circuit breaker")
+	}
+
+	if _, err := ds.userContext(context.Background(), nil); err == nil {
+		t.Errorf("Expected an error passing through a request without a user")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	e := ds.Endpoints[0]
+	e.userPoolLock.Lock()
+	remaining := len(e.userPools)
+	e.userPoolLock.Unlock()
+	if remaining != 0 {
+		t.Errorf("Expected idle user pools to be evicted, %v remain", remaining)
+	}
+}
+
+func TestEntryFunction(t *testing.T) {
+	ds := &KdbDatasource{EntryFunction: ".grafana.query", HealthCheckFunction: ".grafana.health"}
+	ds.setupKdbConnectionHandlers()
+	var called string
+	ds.RunKdbQuerySync = func(_ context.Context, q *kdb.K, _ time.Duration) (*kdb.K, error) {
+		fn := q.Data.([]*kdb.K)[0]
+		if fn.Type != -kdb.KS {
+			t.Errorf("Expected entry function to be sent as a symbol, got type %v", fn.Type)
+			return kdb.Long(2), nil
+		}
+		called = fn.Data.(string)
+		return kdb.Long(2), nil
+	}
+	ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", JSON: []byte(`{"queryText":"1+1"}`)})
+	if called != ".grafana.query" {
+		t.Errorf("Query not sent to configured entry function, called %v", called)
+	}
+	ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if called != ".grafana.health" {
+		t.Errorf("Health check not sent to configured health check function, called %v", called)
+	}
+	ds.HealthCheckFunction = ""
+	ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if called != ".grafana.query" {
+		t.Errorf("Health check not sent to entry function by default, called %v", called)
+	}
+	ds.EntryFunction = ""
+	if fn := ds.entryFunction(); fn.Type != kdb.KC || fn.Data.(string) != defaultEntryFunction {
+		t.Errorf("Expected default value wrapper when no entry function is configured")
+	}
+	// the async wrapper is a lambda, which a .z.ps allowing only the entry function would refuse
+	for _, settings := range []string{`{"asyncQueries":true,"entryFunction":".grafana.query"}`, `{"asyncQueries":true,"healthCheckFunction":".grafana.health"}`} {
+		if _, err := NewKdbDatasource(backend.DataSourceInstanceSettings{JSONData: []byte(settings)}); err == nil {
+			t.Errorf("Expected async queries with an entry function to be refused: %v", settings)
+		}
+	}
+}
+
+func TestFunctionQueryArguments(t *testing.T) {
+	call, err := buildFunctionCall("`.grafana.trades", []QueryArgument{
+		{Type: "symbol", Value: "AAPL"},
+		{Type: "timestamp", Value: "1594671549254"},
+		{Type: "long", Value: "100"},
+		{Type: "float", Value: "1.5"},
+		{Type: "symbolList", Value: "a, b"},
+		{Type: "timestampList", Values: []string{"2020.07.13D20:19:09.254", "2020-07-13T20:19:09.254Z"}},
+	})
+	if err != nil {
+		t.Fatalf("Error building function call: %v", err)
+	}
+	parts := call.Data.([]*kdb.K)
+	expectedTypes := []int8{-kdb.KS, -kdb.KS, -kdb.KP, -kdb.KJ, -kdb.KF, kdb.KS, kdb.KP}
+	if len(parts) != len(expectedTypes) {
+		t.Fatalf("Expected %v items in function call, got %v", len(expectedTypes), len(parts))
+	}
+	for i, k := range parts {
+		if k.Type != expectedTypes[i] {
+			t.Errorf("Item %v of function call has type %v, expected %v", i, k.Type, expectedTypes[i])
+		}
+	}
+	if parts[0].Data.(string) != ".grafana.trades" {
+		t.Errorf("Unexpected function name %v", parts[0].Data)
+	}
+	if syms := parts[5].Data.([]string); len(syms) != 2 || syms[1] != "b" {
+		t.Errorf("Unexpected symbol list %v", syms)
+	}
+	ts := parts[6].Data.([]time.Time)
+	if !ts[0].Equal(ts[1]) || !ts[0].Equal(parts[2].Data.(time.Time)) {
+		t.Errorf("Timestamp formats parsed inconsistently: %v %v %v", parts[2].Data, ts[0], ts[1])
+	}
+	if err := kdb.Encode(io.Discard, kdb.SYNC, call); err != nil {
+		t.Errorf("Error encoding function call: %v", err)
+	}
+
+	niladic, _ := buildFunctionCall(".grafana.now", nil)
+	if err := kdb.Encode(io.Discard, kdb.SYNC, niladic); err != nil || len(niladic.Data.([]*kdb.K)) != 2 {
+		t.Errorf("Function called without arguments should be passed (::): %v", err)
+	}
+	if _, err := buildFunctionCall(".grafana.trades", []QueryArgument{{Type: "long", Value: "abc"}}); err == nil {
+		t.Errorf("Expected error for argument not of its declared type")
+	}
+	if _, err := buildFunctionCall(".grafana.trades", []QueryArgument{{Type: "guid", Value: "abc"}}); err == nil {
+		t.Errorf("Expected error for unsupported argument type")
+	}
+}
+
+func TestVariablesKdbDict(t *testing.T) {
+	dict, err := buildVariablesKdbDict(map[string]QueryVariable{
+		"syms":  {Values: []string{"AAPL", "MSFT"}, Multi: true, Type: "symbol"},
+		"limit": {Values: []string{"100"}, Type: "long"},
+		"name":  {Values: []string{"a b"}},
+		"start": {Values: []string{"1594671549254"}, Type: "timestamp"},
+	})
+	if err != nil {
+		t.Fatalf("Error building variables dict: %v", err)
+	}
+	keys := dict.Data.(kdb.Dict).Key.Data.([]string)
+	values := dict.Data.(kdb.Dict).Value.Data.([]*kdb.K)
+	expected := map[string]int8{"syms": kdb.KS, "limit": -kdb.KJ, "name": kdb.KC, "start": -kdb.KP}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %v variables, got %v", len(expected), keys)
+	}
+	for i, key := range keys {
+		if values[i].Type != expected[key] {
+			t.Errorf("Variable %v has type %v, expected %v", key, values[i].Type, expected[key])
+		}
+	}
+	if keys[0] != "limit" || values[0].Data.(int64) != 100 {
+		t.Errorf("Variables not sorted by name or cast incorrectly: %v %v", keys, values[0].Data)
+	}
+
+	empty, err := buildVariablesKdbDict(nil)
+	if err != nil || len(empty.Data.(kdb.Dict).Key.Data.([]string)) != 0 {
+		t.Errorf("Expected empty variables dict without variables: %v", err)
+	}
+	if _, err := buildVariablesKdbDict(map[string]QueryVariable{"limit": {Values: []string{"all"}, Type: "long"}}); err == nil {
+		t.Errorf("Expected error casting variable to its type hint")
+	}
+}
+
+func TestExpandMacros(t *testing.T) {
+	from := time.Date(2020, 7, 13, 20, 19, 9, 254000000, time.UTC)
+	q := backend.DataQuery{
+		TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+		Interval:  90 * time.Second,
+	}
+	text, err := expandMacros("select last price by $__timeBucket(time) from trade where $__timeFilter( time ), i<$__interval_ms", q)
+	if err != nil {
+		t.Fatalf("Error expanding macros: %v", err)
+	}
+	expected := "select last price by (0D00:01:30.000000000 xbar time) from trade where (time within 2020.07.13D20:19:09.254000000 2020.07.13D21:19:09.254000000), i<90000"
+	if text != expected {
+		t.Errorf("Unexpected macro expansion:\n%v\nexpected:\n%v", text, expected)
+	}
+	text, _ = expandMacros("$__from,$__to,$__interval,$__fromX", q)
+	if text != "2020.07.13D20:19:09.254000000,2020.07.13D21:19:09.254000000,0D00:01:30.000000000,$__fromX" {
+		t.Errorf("Unexpected variable macro expansion: %v", text)
+	}
+
+	// without an interval the time range is divided into max data points
+	q.Interval = 0
+	q.MaxDataPoints = 2
+	if text, _ = expandMacros("$__interval", q); text != "0D00:30:00.000000000" {
+		t.Errorf("Unexpected interval from max data points: %v", text)
+	}
+	if _, err = expandMacros("$__timeFilter()", q); err == nil {
+		t.Errorf("Expected error for macro without a column")
+	}
+}
+
+// formatParseTree renders a parse tree in the form kdb+ displays it, so tests can check exactly what is sent
+func formatParseTree(k *kdb.K) string {
+	switch k.Type {
+	case kdb.KFUNCBP:
+		return string(":+-*%&|^=<>$,#_~!?@."[k.Data.(byte)])
+	case -kdb.KB:
+		if k.Data.(bool) {
+			return "1b"
+		}
+		return "0b"
+	case -kdb.KJ:
+		return fmt.Sprint(k.Data.(int64))
+	case -kdb.KS:
+		return "`" + k.Data.(string)
+	case kdb.KC:
+		return fmt.Sprintf("%q", k.Data.(string))
+	case kdb.KS:
+		syms := k.Data.([]string)
+		if len(syms) == 1 {
+			return ",`" + syms[0]
+		}
+		return "`" + strings.Join(syms, "`")
+	case kdb.KP:
+		times := []string{}
+		for _, t := range k.Data.([]time.Time) {
+			times = append(times, t.Format("2006.01.02D15:04:05.000000000"))
+		}
+		return strings.Join(times, " ")
+	case kdb.KN:
+		spans := []string{}
+		for _, d := range k.Data.([]time.Duration) {
+			spans = append(spans, fmt.Sprintf("0D%02d:%02d:%02d.%09d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Nanoseconds()%1e9))
+		}
+		if len(spans) == 1 {
+			return "," + spans[0]
+		}
+		return strings.Join(spans, " ")
+	case kdb.KFUNC:
+		return k.Data.(kdb.Function).Body
+	case kdb.XD:
+		dict := k.Data.(kdb.Dict)
+		return formatParseTree(dict.Key) + "!" + formatParseTree(dict.Value)
+	case kdb.K0:
+		items := []string{}
+		for _, item := range k.Data.([]*kdb.K) {
+			items = append(items, formatParseTree(item))
+		}
+		if len(items) == 1 {
+			return "enlist " + items[0]
+		}
+		return "(" + strings.Join(items, ";") + ")"
+	}
+	return fmt.Sprint(k.Data)
+}
+
+func TestCompileBuilderQuery(t *testing.T) {
+	from := time.Date(2020, 7, 13, 20, 0, 0, 0, time.UTC)
+	q := backend.DataQuery{TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)}, Interval: time.Minute}
+	within := "(`.q.within;`time;2020.07.13D20:00:00.000000000 2020.07.13D21:00:00.000000000)"
+	bucket := "(`.q.xbar;(`.q.first;,0D00:01:00.000000000);`time)"
+	columns := []BuilderColumn{{Name: "price", Aggregation: "avg"}, {Name: "size", Aggregation: "sum", Alias: "volume"}}
+	filters := []BuilderFilter{{Column: "sym", Operator: "in", Value: QueryArgument{Type: "symbolList", Value: "AAPL,MSFT"}}, {Column: "ex", Operator: "=", Value: QueryArgument{Type: "symbol", Value: "N"}}}
+	tests := []struct {
+		name    string
+		builder *BuilderQuery
+		tree    string
+		unkey   bool
+	}{
+		{
+			name:    "ungrouped",
+			builder: &BuilderQuery{Table: "trade"},
+			tree:    "(?;`trade;();0b;())",
+		},
+		{
+			name:    "grouped",
+			builder: &BuilderQuery{Table: "trade", Columns: columns, Where: filters, By: []string{"sym"}, TimeColumn: "time"},
+			tree: "(?;`trade;(" + within + ";(`.q.in;`sym;enlist `AAPL`MSFT);(=;`ex;,`N));,`sym!enlist `sym;" +
+				"`price`volume!((`.q.avg;`price);(`.q.sum;`size)))",
+			unkey: true,
+		},
+		{
+			name:    "bucketed",
+			builder: &BuilderQuery{Table: "trade", Columns: columns, TimeColumn: "time", TimeBucket: true},
+			tree:    "(?;`trade;enlist " + within + ";,`time!enlist " + bucket + ";`price`volume!((`.q.avg;`price);(`.q.sum;`size)))",
+			unkey:   true,
+		},
+		{
+			name:    "bucketed and grouped",
+			builder: &BuilderQuery{Table: "trade", Columns: columns, By: []string{"sym"}, TimeColumn: "time", TimeBucket: true},
+			tree: "(?;`trade;enlist " + within + ";,`sym!enlist `sym;`time`price`volume!(" +
+				"(`.q.asc;(`.q.distinct;" + bucket + "));" +
+				"(`.q.each;`.q.avg;(@;`price;(@;(`.q.group;" + bucket + ");(`.q.asc;(`.q.key;(`.q.group;" + bucket + "))))));" +
+				"(`.q.each;`.q.sum;(@;`size;(@;(`.q.group;" + bucket + ");(`.q.asc;(`.q.key;(`.q.group;" + bucket + "))))))))",
+		},
+	}
+	for _, test := range tests {
+		sel, err := compileBuilderQuery(test.builder, q)
+		if err != nil {
+			t.Errorf("Error compiling %v builder query: %v", test.name, err)
+			continue
+		}
+		if tree := formatParseTree(sel); tree != test.tree {
+			t.Errorf("Unexpected %v functional select:\n%v\nexpected:\n%v", test.name, tree, test.tree)
+		}
+		if err := kdb.Encode(io.Discard, kdb.SYNC, sel); err != nil {
+			t.Errorf("Error encoding %v functional select: %v", test.name, err)
+		}
+		if test.builder.unkeysResult() != test.unkey {
+			t.Errorf("Expected %v result to be unkeyed: %v", test.name, test.unkey)
+		}
+	}
+
+	keyed := kdb.NewDict(kdb.NewTable([]string{"sym"}, []*kdb.K{kdb.SymbolV([]string{"AAPL"})}), kdb.NewTable([]string{"price"}, []*kdb.K{kdb.FloatV([]float64{1.5})}))
+	if tbl := unkeyKdbTable(keyed); tbl.Type != kdb.XT || strings.Join(tbl.Data.(kdb.Table).Columns, ",") != "sym,price" {
+		t.Errorf("Keyed table not unkeyed: %v", tbl)
+	}
+
+	if _, err := compileBuilderQuery(&BuilderQuery{}, q); err == nil {
+		t.Errorf("Expected error without a table")
+	}
+	if _, err := compileBuilderQuery(&BuilderQuery{Table: "trade", Columns: []BuilderColumn{{Name: "price", Aggregation: "mode"}}}, q); err == nil {
+		t.Errorf("Expected error for unsupported aggregation")
+	}
+	if _, err := compileBuilderQuery(&BuilderQuery{Table: "trade", Where: []BuilderFilter{{Column: "price", Operator: "!=", Value: QueryArgument{Type: "float", Value: "1"}}}}, q); err == nil {
+		t.Errorf("Expected error for unsupported operator")
+	}
+}
+
+func TestFiltersKdbTable(t *testing.T) {
+	tbl, err := buildFiltersKdbTable([]AdhocFilter{
+		{Key: "sym", Operator: "=", Value: "AAPL", Type: "symbol"},
+		{Key: "size", Operator: ">", Value: "100", Type: "long"},
+		{Key: "ex", Operator: "=~", Value: "N.*", Type: "symbol"},
+		{Key: "cond", Operator: "!=", Value: "A"},
+	})
+	if err != nil {
+		t.Fatalf("Error building filters table: %v", err)
+	}
+	data := tbl.Data.(kdb.Table).Data
+	if ops := data[1].Data.([]string); strings.Join(ops, " ") != "= > =~ !=" {
+		t.Errorf("Unexpected operators %v", ops)
+	}
+	expected := []int8{-kdb.KS, -kdb.KJ, kdb.KC, kdb.KC}
+	for i, v := range data[2].Data.([]*kdb.K) {
+		if v.Type != expected[i] {
+			t.Errorf("Filter %v value has type %v, expected %v", i, v.Type, expected[i])
+		}
+	}
+	if _, err := buildFiltersKdbTable([]AdhocFilter{{Key: "size", Operator: ">", Value: "big", Type: "long"}}); err == nil {
+		t.Errorf("Expected error casting filter value to its type")
+	}
+}
+
+type mockResourceSender struct {
+	res *backend.CallResourceResponse
+}
+
+func (s *mockResourceSender) Send(res *backend.CallResourceResponse) error {
+	s.res = res
+	return nil
+}
+
+func TestTagResources(t *testing.T) {
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	ds.setupResourceHandlers()
+	var sent string
+	ds.RunKdbQuerySync = func(_ context.Context, q *kdb.K, _ time.Duration) (*kdb.K, error) {
+		query := q.Data.([]*kdb.K)[1].Data.(kdb.Dict).Value.Data.([]*kdb.K)[5].Data.(kdb.Dict).Value.Data.([]*kdb.K)
+		sent = formatParseTree(query[0])
+		switch query[1].Data.(string) {
+		case "TAGKEYS":
+			return kdb.NewDict(
+				kdb.NewTable([]string{"c"}, []*kdb.K{kdb.SymbolV([]string{"time", "sym", "size"})}),
+				kdb.NewTable([]string{"t", "f", "a"}, []*kdb.K{kdb.Atom(kdb.KC, "psj"), kdb.SymbolV([]string{"", "", ""}), kdb.SymbolV([]string{"", "", ""})})), nil
+		case "TAGVALUES":
+			return kdb.NewTable([]string{"sym"}, []*kdb.K{kdb.SymbolV([]string{"AAPL", "MSFT"})}), nil
+		}
+		return nil, fmt.Errorf("unexpected query type %v", query[1].Data)
+	}
+
+	sender := &mockResourceSender{}
+	ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "tag-keys", URL: "tag-keys?table=trade", Method: "GET"}, sender)
+	if sender.res == nil || sender.res.Status != 200 || string(sender.res.Body) != `[{"text":"time","type":"timestamp"},{"text":"sym","type":"symbol"},{"text":"size","type":"long"}]` {
+		t.Errorf("Unexpected tag keys response: %+v", sender.res)
+	}
+	if sent != "(`.q.meta;`trade)" {
+		t.Errorf("Expected meta to be applied to the table name, sent %v", sent)
+	}
+	ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "tag-values", URL: "tag-values?table=trade&key=sym", Method: "GET"}, sender)
+	if sender.res == nil || sender.res.Status != 200 || string(sender.res.Body) != `[{"text":"AAPL"},{"text":"MSFT"}]` {
+		t.Errorf("Unexpected tag values response: %+v", sender.res)
+	}
+	if sent != "(?;`trade;();1b;,`sym!,`sym)" {
+		t.Errorf("Unexpected tag values select %v", sent)
+	}
+	ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "tag-values", URL: "tag-values?table=trade", Method: "GET"}, sender)
+	if sender.res == nil || sender.res.Status != 400 {
+		t.Errorf("Expected bad request for tag values without a key: %+v", sender.res)
+	}
+}
+
+func TestSchemaResourcesCached(t *testing.T) {
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	ds.setupResourceHandlers()
+	var calls int32
+	ds.RunKdbQuerySync = func(_ context.Context, q *kdb.K, _ time.Duration) (*kdb.K, error) {
+		atomic.AddInt32(&calls, 1)
+		query := q.Data.([]*kdb.K)[1].Data.(kdb.Dict).Value.Data.([]*kdb.K)[5].Data.(kdb.Dict).Value.Data.([]*kdb.K)
+		switch query[1].Data.(string) {
+		case "TABLES":
+			return kdb.SymbolV([]string{"quote", "trade"}), nil
+		case "PARTITIONS":
+			return nil, fmt.Errorf(".Q.pt")
+		}
+		return nil, fmt.Errorf("unexpected query type %v", query[1].Data)
+	}
+	call := func(method string, url string) *backend.CallResourceResponse {
+		sender := &mockResourceSender{}
+		path := strings.SplitN(url, "?", 2)[0]
+		ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: path, URL: url, Method: method}, sender)
+		return sender.res
+	}
+
+	for i := 0; i < 2; i++ {
+		if res := call("GET", "schema/tables"); res.Status != 200 || string(res.Body) != `["quote","trade"]` {
+			t.Errorf("Unexpected tables response: %+v", res)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("Expected cached tables to be served without querying kdb+, queried %v times", calls)
+	}
+	call("GET", "schema/tables?refresh=true")
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("Expected refresh=true to bypass the cache")
+	}
+	if res := call("POST", "schema/refresh"); res.Status != 200 {
+		t.Errorf("Unexpected refresh response: %+v", res)
+	}
+	call("GET", "schema/tables")
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("Expected tables to be fetched again after the cache was refreshed")
+	}
+	if res := call("GET", "schema/partitions"); res.Status != 200 || !strings.Contains(string(res.Body), `"partitioned":false`) {
+		t.Errorf("Expected a process without a partitioned database to be reported as such: %+v", res)
+	}
+}
+
+func TestSchemaQueries(t *testing.T) {
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	ds.setupResourceHandlers()
+	sent := []string{}
+	ds.RunKdbQuerySync = func(_ context.Context, q *kdb.K, _ time.Duration) (*kdb.K, error) {
+		query := q.Data.([]*kdb.K)[1].Data.(kdb.Dict).Value.Data.([]*kdb.K)[5].Data.(kdb.Dict).Value.Data.([]*kdb.K)
+		sent = append(sent, formatParseTree(query[0]))
+		switch query[1].Data.(string) {
+		case "META":
+			return kdb.NewDict(
+				kdb.NewTable([]string{"c"}, []*kdb.K{kdb.SymbolV([]string{"time", "sym"})}),
+				kdb.NewTable([]string{"t", "f", "a"}, []*kdb.K{kdb.Atom(kdb.KC, "ps"), kdb.SymbolV([]string{"", ""}), kdb.SymbolV([]string{"", "p"})})), nil
+		case "FUNCTIONS":
+			if len(sent)%2 == 1 {
+				return kdb.SymbolV([]string{"f"}), nil
+			}
+			// value of a function's name is the function, and only value of the function breaks it down
+			lambda := kdb.NewFunc("", "{[x;y] x+y}")
+			if query[0].Type != kdb.K0 || query[0].Data.([]*kdb.K)[0].Type != kdb.KFUNC || !strings.Contains(sent[len(sent)-1], "value value") {
+				return kdb.NewList(lambda), nil
+			}
+			return kdb.NewList(kdb.NewList(kdb.Atom(kdb.KG, []byte{0}), kdb.SymbolV([]string{"x", "y"}))), nil
+		}
+		return kdb.SymbolV([]string{"a"}), nil
+	}
+	// arguments are sent as the values the function is applied to, not quoted as in a parse tree
+	expected := map[string][]string{
+		"schema/namespaces":              {"(`.q.key;`)"},
+		"schema/tables?namespace=.ns":    {"(`.q.tables;`.ns)"},
+		"schema/meta?table=trade":        {"(`.q.meta;`trade)"},
+		"schema/functions?namespace=.ns": {`(` + "`.q.system" + `;"f .ns")`, "({(value value@)each x};,`.ns.f)"},
+	}
+	for url, queries := range expected {
+		sent = []string{}
+		sender := &mockResourceSender{}
+		ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: strings.SplitN(url, "?", 2)[0], URL: url, Method: "GET"}, sender)
+		if sender.res == nil || sender.res.Status != 200 {
+			t.Errorf("Unexpected response from %v: %+v", url, sender.res)
+		}
+		if strings.Join(sent, "\n") != strings.Join(queries, "\n") {
+			t.Errorf("Unexpected queries sent for %v: %v, expected %v", url, sent, queries)
+		}
+		if strings.HasPrefix(url, "schema/functions") && string(sender.res.Body) != `[{"name":"f","params":["x","y"]}]` {
+			t.Errorf("Expected the parameters of functions, got %s", sender.res.Body)
+		}
+	}
+}
+
+func TestVariableQueryResource(t *testing.T) {
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	ds.setupResourceHandlers()
+	ds.RunKdbQuerySync = func(_ context.Context, q *kdb.K, _ time.Duration) (*kdb.K, error) {
+		query := q.Data.([]*kdb.K)[1].Data.(kdb.Dict).Value.Data.([]*kdb.K)[5].Data.(kdb.Dict).Value.Data.([]*kdb.K)
+		if query[1].Data.(string) == "bad" {
+			return nil, fmt.Errorf("type")
+		}
+		return kdb.NewTable([]string{"name", "sym"}, []*kdb.K{
+			kdb.SymbolV([]string{"Microsoft", "Apple", "Microsoft"}),
+			kdb.SymbolV([]string{"MSFT", "AAPL", "MSFT"})}), nil
+	}
+	call := func(body string) *backend.CallResourceResponse {
+		sender := &mockResourceSender{}
+		ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "variable-query", URL: "variable-query", Method: "POST", Body: []byte(body)}, sender)
+		return sender.res
+	}
+
+	res := call(`{"queryText":"select name, sym from instruments","timeOut":1000}`)
+	if res.Status != 200 || string(res.Body) != `[{"text":"Apple","value":"AAPL"},{"text":"Microsoft","value":"MSFT"}]` {
+		t.Errorf("Unexpected variable query response: %v %s", res.Status, res.Body)
+	}
+	res = call(`{"queryText":"bad"}`)
+	if res.Status != 500 || !strings.Contains(string(res.Body), "type") {
+		t.Errorf("Expected kdb+ error to be returned as an error: %v %s", res.Status, res.Body)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	ds := &KdbDatasource{ValidateQueries: true, parseTimeout: defaultParseTimeout}
+	ds.setupKdbConnectionHandlers()
+	ds.setupResourceHandlers()
+	executed := 0
+	ds.RunKdbQuerySync = func(_ context.Context, q *kdb.K, timeout time.Duration) (*kdb.K, error) {
+		query := q.Data.([]*kdb.K)[1].Data.(kdb.Dict).Value.Data.([]*kdb.K)[5].Data.(kdb.Dict).Value.Data.([]*kdb.K)
+		if query[1].Type != -kdb.KS || query[1].Data.(string) != "PARSE" {
+			executed++
+			return kdb.NewTable([]string{"x"}, []*kdb.K{kdb.LongV([]int64{1})}), nil
+		}
+		if timeout != defaultParseTimeout {
+			t.Errorf("Expected parse to run under the parse timeout, got %v", timeout)
+		}
+		check := query[0].Data.([]*kdb.K)
+		if check[0].Type != kdb.KFUNC || check[1].Type != kdb.KC {
+			t.Errorf("Expected parse check function applied to query text")
+		}
+		if locateParseError(check[1].Data.(string)) >= 0 {
+			return kdb.NewList(kdb.Atom(-kdb.KB, false), kdb.Atom(kdb.KC, ")")), nil
+		}
+		return kdb.NewList(kdb.Atom(-kdb.KB, true), kdb.Atom(kdb.KC, "")), nil
+	}
+	call := func(body string) *backend.CallResourceResponse {
+		sender := &mockResourceSender{}
+		ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "parse", URL: "parse", Method: "POST", Body: []byte(body)}, sender)
+		return sender.res
+	}
+
+	res := call(`{"queryText":"select from trade where $__timeFilter(time)"}`)
+	if res.Status != 200 || string(res.Body) != `{"valid":true}` {
+		t.Errorf("Unexpected parse response: %v %s", res.Status, res.Body)
+	}
+	res = call(`{"queryText":"select from trade\nwhere (price>1"}`)
+	if res.Status != 200 || string(res.Body) != `{"valid":false,"error":")","position":24,"line":2,"column":7}` {
+		t.Errorf("Unexpected parse response: %v %s", res.Status, res.Body)
+	}
+	if executed != 0 {
+		t.Errorf("Parse requests should not execute queries")
+	}
+
+	for text, valid := range map[string]bool{"select from t": true, "f[1;(2": false} {
+		resp := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", JSON: []byte(`{"queryText":"` + text + `"}`)})
+		if valid && resp.Error != nil {
+			t.Errorf("Unexpected error running valid query: %v", resp.Error)
+		}
+		if !valid && (resp.Error == nil || !strings.Contains(resp.Error.Error(), "Query failed to parse")) {
+			t.Errorf("Expected query which does not parse to be refused, got %v", resp.Error)
+		}
+	}
+	if executed != 1 {
+		t.Errorf("Expected only the valid query to be executed, executed %v", executed)
+	}
+}
+
+func TestLocateParseError(t *testing.T) {
+	cases := map[string]int{
+		"select from t":            -1,
+		"f[1;2)":                   5,
+		"select from t where (a>1": 20,
+		`"unterminated`:            0,
+		`x:"a)b" / comment (`:      -1,
+		`{x+1}[2] ]`:               9,
+		`"esc\"aped" (`:            12,
+	}
+	for text, expected := range cases {
+		if pos := locateParseError(text); pos != expected {
+			t.Errorf("Expected parse error in %q at %v, got %v", text, expected, pos)
+		}
+	}
+}
+
+func TestAnnotationQuery(t *testing.T) {
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	t0 := time.Date(2022, 3, 1, 14, 30, 0, 0, time.UTC)
+	ds.RunKdbQuerySync = func(context.Context, *kdb.K, time.Duration) (*kdb.K, error) {
+		return kdb.NewTable([]string{"time", "timeEnd", "title", "text", "tags", "other"}, []*kdb.K{
+			kdb.Atom(kdb.KP, []time.Time{t0, t0.Add(time.Hour), t0.Add(2 * time.Hour)}),
+			kdb.Atom(kdb.KP, []time.Time{t0.Add(time.Minute), t0.Add(time.Hour), t0.Add(2 * time.Hour)}),
+			kdb.SymbolV([]string{"halt", "deploy", "halt"}),
+			kdb.NewList(kdb.Atom(kdb.KC, "Trading halted"), kdb.Atom(kdb.KC, "v1.2"), kdb.Atom(kdb.KC, "")),
+			kdb.NewList(kdb.SymbolV([]string{"AAPL", "LSE"}), kdb.Atom(kdb.KC, "gateway,prod"), kdb.NewList()),
+			kdb.LongV([]int64{1, 2, 3}),
+		}), nil
+	}
+	res := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "Anno", QueryType: "annotation", JSON: []byte(`{"queryText":"events"}`)})
+	if res.Error != nil {
+		t.Fatalf("Error running annotation query: %v", res.Error)
+	}
+	if len(res.Frames) != 1 {
+		t.Fatalf("Expected a single annotation frame, got %v", len(res.Frames))
+	}
+	frame := res.Frames[0]
+	names := []string{}
+	for _, f := range frame.Fields {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "time,timeEnd,title,text,tags" {
+		t.Errorf("Unexpected annotation fields: %v", names)
+	}
+	if frame.Name != "Anno" || frame.Fields[0].At(0).(time.Time) != t0 || frame.Fields[3].At(0).(string) != "Trading halted" {
+		t.Errorf("Unexpected annotation frame contents")
+	}
+	for i, expected := range []string{"AAPL,LSE", "gateway,prod", ""} {
+		if tags := frame.Fields[4].At(i).(string); tags != expected {
+			t.Errorf("Expected tags %q at row %v, got %q", expected, i, tags)
+		}
+	}
+
+	ds.RunKdbQuerySync = func(context.Context, *kdb.K, time.Duration) (*kdb.K, error) {
+		return kdb.NewTable([]string{"time", "sym"}, []*kdb.K{kdb.Atom(kdb.KP, []time.Time{t0}), kdb.SymbolV([]string{"a"})}), nil
+	}
+	res = ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "Anno", QueryType: "annotation", JSON: []byte(`{"queryText":"events"}`)})
+	if res.Error == nil {
+		t.Errorf("Expected an error for an annotation table without title or text")
+	}
+}
+
+func TestLogsQuery(t *testing.T) {
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	t0 := time.Date(2022, 3, 1, 14, 0, 0, 0, time.UTC)
+	ds.RunKdbQuerySync = func(context.Context, *kdb.K, time.Duration) (*kdb.K, error) {
+		return kdb.NewTable([]string{"time", "msg", "lvl", "host", "id"}, []*kdb.K{
+			kdb.Atom(kdb.KP, []time.Time{t0, t0.Add(10 * time.Second), t0.Add(70 * time.Second), t0.Add(2 * time.Hour)}),
+			kdb.NewList(kdb.Atom(kdb.KC, "started"), kdb.Atom(kdb.KC, "order rejected"), kdb.Atom(kdb.KC, "done"), kdb.Atom(kdb.KC, "late")),
+			kdb.SymbolV([]string{"info", "error", "", "info"}),
+			kdb.SymbolV([]string{"gw1", "gw2", "gw1", "gw1"}),
+			kdb.LongV([]int64{1, 2, 3, 4}),
+		}), nil
+	}
+	model := []byte(`{"queryText":"logs","logs":{"messageColumn":"msg","levelColumn":"lvl","labelColumns":["host"]}}`)
+	tr := backend.TimeRange{From: t0, To: t0.Add(time.Hour)}
+
+	res := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", QueryType: "logs", JSON: model, TimeRange: tr})
+	if res.Error != nil {
+		t.Fatalf("Error running logs query: %v", res.Error)
+	}
+	if len(res.Frames) != 2 {
+		t.Fatalf("Expected a logs frame per host, got %v", len(res.Frames))
+	}
+	gw1 := res.Frames[0]
+	if gw1.Meta == nil || gw1.Meta.PreferredVisualization != "logs" {
+		t.Errorf("Expected logs frames to prefer the logs visualisation")
+	}
+	if len(gw1.Fields) != 3 || gw1.Fields[1].Labels["host"] != "gw1" || gw1.Fields[0].Len() != 3 {
+		t.Errorf("Unexpected logs frame for gw1: %v fields", len(gw1.Fields))
+	}
+	if gw1.Fields[1].At(1).(string) != "done" || gw1.Fields[2].Name != "level" || gw1.Fields[2].At(1).(string) != "unknown" {
+		t.Errorf("Unexpected log line in gw1 frame")
+	}
+
+	res = ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", QueryType: "logVolume", JSON: model, TimeRange: tr, Interval: time.Minute})
+	if res.Error != nil {
+		t.Fatalf("Error running log volume query: %v", res.Error)
+	}
+	counts := map[string][]int64{}
+	for _, frame := range res.Frames {
+		if frame.Fields[0].Len() != 61 {
+			t.Errorf("Expected a bucket per minute of the time range, got %v", frame.Fields[0].Len())
+		}
+		level := frame.Fields[1].Labels["level"]
+		for i := 0; i < 2; i++ {
+			counts[level] = append(counts[level], frame.Fields[1].At(i).(int64))
+		}
+	}
+	if fmt.Sprint(counts) != "map[error:[1 0] info:[1 0] unknown:[0 1]]" {
+		t.Errorf("Unexpected log volume counts: %v", counts)
+	}
+
+	// an interval far smaller than the time range is widened to fit the max data points
+	res = ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", QueryType: "logVolume", JSON: model, TimeRange: tr, Interval: time.Nanosecond, MaxDataPoints: 100})
+	if res.Error != nil {
+		t.Fatalf("Error running log volume query: %v", res.Error)
+	}
+	total := int64(0)
+	for _, frame := range res.Frames {
+		if frame.Fields[0].Len() > 100 {
+			t.Errorf("Expected at most 100 log volume buckets, got %v", frame.Fields[0].Len())
+		}
+		for i := 0; i < frame.Fields[1].Len(); i++ {
+			total += frame.Fields[1].At(i).(int64)
+		}
+	}
+	if total != 3 {
+		t.Errorf("Expected the 3 log lines in the time range to be counted, got %v", total)
+	}
+
+	res = ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{RefID: "A", QueryType: "logs", JSON: []byte(`{"queryText":"logs"}`), TimeRange: tr})
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "message") {
+		t.Errorf("Expected an error for a log table without a message column, got %v", res.Error)
+	}
+}
+
+type mockStreamMsg struct {
+	k       *kdb.K
+	msgtype kdb.ReqType
+}
+
+// mockStreamConn is a stream handle whose reads are fed by the test
+type mockStreamConn struct {
+	reads  chan mockStreamMsg
+	writes chan *kdb.K
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newMockStreamConn() *mockStreamConn {
+	return &mockStreamConn{reads: make(chan mockStreamMsg, 10), writes: make(chan *kdb.K, 10), closed: make(chan struct{})}
+}
+
+func (c *mockStreamConn) ReadMessage() (*kdb.K, kdb.ReqType, error) {
+	select {
+	case msg := <-c.reads:
+		return msg.k, msg.msgtype, nil
+	case <-c.closed:
+		return nil, kdb.RESPONSE, io.EOF
+	}
+}
+
+func (c *mockStreamConn) WriteMessage(_ kdb.ReqType, k *kdb.K) error {
+	c.writes <- k
+	return nil
+}
+
+func (c *mockStreamConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+type mockPacketSender struct {
+	packets chan *backend.StreamPacket
+}
+
+func (s *mockPacketSender) Send(p *backend.StreamPacket) error {
+	s.packets <- p
+	return nil
+}
+
+func TestTickStream(t *testing.T) {
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	conn := newMockStreamConn()
+	ds.OpenStreamConnection = func(string) (kdbConn, error) { return conn, nil }
+
+	res := ds.query(context.Background(), backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "kdb1"}},
+		backend.DataQuery{RefID: "A", QueryType: "stream", JSON: []byte(`{"stream":{"table":"trade","syms":["AAPL","MSFT"]}}`)})
+	if res.Error != nil || len(res.Frames) != 1 || res.Frames[0].Meta.Channel != "ds/kdb1/tick/trade/AAPL/MSFT" {
+		t.Fatalf("Expected a frame with the stream's channel, got %v", res.Error)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sender := &mockPacketSender{packets: make(chan *backend.StreamPacket, 10)}
+	errChan := make(chan error)
+	go func() {
+		errChan <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: "tick/trade/AAPL/MSFT"}, backend.NewStreamSender(sender))
+	}()
+
+	sub := (<-conn.writes).Data.([]*kdb.K)
+	if sub[0].Data.(string) != ".u.sub" || sub[1].Data.(string) != "trade" || strings.Join(sub[2].Data.([]string), ",") != "AAPL,MSFT" {
+		t.Errorf("Unexpected subscription message")
+	}
+	schema := kdb.NewTable([]string{"time", "sym", "price"}, []*kdb.K{kdb.Atom(kdb.KN, []time.Duration{}), kdb.SymbolV([]string{}), kdb.FloatV([]float64{})})
+	conn.reads <- mockStreamMsg{kdb.NewList(kdb.Symbol("trade"), schema), kdb.RESPONSE}
+	conn.reads <- mockStreamMsg{kdb.NewList(kdb.Symbol("upd"), kdb.Symbol("trade"), kdb.NewTable([]string{"time", "sym", "price"},
+		[]*kdb.K{kdb.Atom(kdb.KN, []time.Duration{time.Hour}), kdb.SymbolV([]string{"AAPL"}), kdb.FloatV([]float64{1.5})})), kdb.ASYNC}
+	conn.reads <- mockStreamMsg{kdb.NewList(kdb.Symbol("upd"), kdb.Symbol("quote"), kdb.NewTable([]string{"sym"}, []*kdb.K{kdb.SymbolV([]string{"IBM"})})), kdb.ASYNC}
+	conn.reads <- mockStreamMsg{kdb.NewList(kdb.Symbol("upd"), kdb.Symbol("trade"),
+		kdb.NewList(kdb.Atom(-kdb.KN, 2*time.Hour), kdb.Symbol("MSFT"), kdb.Float(2.25))), kdb.ASYNC}
+
+	first := string((<-sender.packets).Data)
+	second := string((<-sender.packets).Data)
+	if !strings.Contains(first, "schema") || !strings.Contains(first, "AAPL") || !strings.Contains(first, "1.5") {
+		t.Errorf("Unexpected first stream frame: %v", first)
+	}
+	if strings.Contains(second, "schema") || !strings.Contains(second, "MSFT") || !strings.Contains(second, "2.25") {
+		t.Errorf("Unexpected second stream frame: %v", second)
+	}
+	midnight := time.Now().UTC().Truncate(24 * time.Hour)
+	if !strings.Contains(first, strconv.FormatInt(midnight.Add(time.Hour).UnixNano()/int64(time.Millisecond), 10)) {
+		t.Errorf("Expected tickerplant timespans to be today's timestamps: %v", first)
+	}
+
+	cancel()
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Errorf("Expected stream to end cleanly when cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Stream did not end when cancelled")
+	}
+	if len(sender.packets) != 0 {
+		t.Errorf("Updates to other tables should not be streamed")
+	}
+}
+
+func TestTickerplantEndpoint(t *testing.T) {
+	ds := &KdbDatasource{Endpoints: []*kdbEndpoint{{Host: "primary", Port: 5000}, {Host: "secondary", Port: 5000}}}
+	if e := ds.tickerplantEndpoint(); e.Host != "primary" || e.Port != 5000 {
+		t.Errorf("Expected the active endpoint without a tickerplant configured, got %v:%v", e.Host, e.Port)
+	}
+	// a tickerplant port without a host is on the active endpoint's host, as Host is empty with an endpoints list
+	ds.TickerplantPort = 5010
+	ds.Endpoints[0].ejected = true
+	if e := ds.tickerplantEndpoint(); e.Host != "secondary" || e.Port != 5010 {
+		t.Errorf("Expected the tickerplant port on the active endpoint's host, got %v:%v", e.Host, e.Port)
+	}
+	ds.TickerplantHost = "tp"
+	if e := ds.tickerplantEndpoint(); e.Host != "tp" || e.Port != 5010 {
+		t.Errorf("Expected the configured tickerplant, got %v:%v", e.Host, e.Port)
+	}
+}
+
+func TestTickStreamUserPassthrough(t *testing.T) {
+	ds := &KdbDatasource{UserPassthrough: true}
+	ds.setupKdbConnectionHandlers()
+	conn := newMockStreamConn()
+	logins := make(chan string, 1)
+	ds.OpenStreamConnection = func(login string) (kdbConn, error) {
+		logins <- login
+		return conn, nil
+	}
+	alice := &backend.User{Login: "alice@example.com"}
+	pCtx := backend.PluginContext{User: alice, DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "kdb1"}}
+	res := ds.query(context.Background(), pCtx, backend.DataQuery{RefID: "A", QueryType: "stream", JSON: []byte(`{"stream":{"table":"trade"}}`)})
+	path := "tick/trade/user=" + hex.EncodeToString([]byte(alice.Login))
+	if res.Error != nil || len(res.Frames) != 1 || res.Frames[0].Meta.Channel != "ds/kdb1/"+path {
+		t.Fatalf("Expected the stream's channel to name the user, got %v", res.Error)
+	}
+
+	subscribe := func(path string, user *backend.User) backend.SubscribeStreamStatus {
+		res, _ := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: backend.PluginContext{User: user}, Path: path})
+		return res.Status
+	}
+	if status := subscribe(path, alice); status != backend.SubscribeStreamStatusOK {
+		t.Errorf("Expected the user to be able to subscribe to their own stream, got %v", status)
+	}
+	if status := subscribe(path, &backend.User{Login: "bob"}); status != backend.SubscribeStreamStatusPermissionDenied {
+		t.Errorf("Expected another user to be refused the stream, got %v", status)
+	}
+	if status := subscribe("tick/trade", alice); status != backend.SubscribeStreamStatusPermissionDenied {
+		t.Errorf("Expected a stream without a user to be refused, got %v", status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ds.RunStream(ctx, &backend.RunStreamRequest{Path: path}, backend.NewStreamSender(&mockPacketSender{packets: make(chan *backend.StreamPacket, 10)}))
+	select {
+	case login := <-logins:
+		if login != alice.Login {
+			t.Errorf("Expected the tickerplant to be dialled as %v, got %q", alice.Login, login)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Stream connection not opened")
+	}
+	if ds.userCredentials(alice.Login) != "alice@example.com:" {
+		t.Errorf("Unexpected credentials for passed-through user: %v", ds.userCredentials(alice.Login))
+	}
+}
+
+func TestPollStream(t *testing.T) {
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	var polls int32
+	ds.RunKdbQuerySync = func(context.Context, *kdb.K, time.Duration) (*kdb.K, error) {
+		n := int64(atomic.AddInt32(&polls, 1))
+		// each poll drops the oldest id and adds a new one
+		return kdb.NewTable([]string{"id", "v"}, []*kdb.K{kdb.LongV([]int64{n, n + 1}), kdb.FloatV([]float64{float64(n), float64(n + 1)})}), nil
+	}
+	pCtx := backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "kdb1"}}
+	model := []byte(`{"queryText":"select from t","stream":{"mode":"poll","interval":20,"keyColumn":"id"}}`)
+	tr := backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()}
+	channels := []string{}
+	for i := 0; i < 2; i++ {
+		res := ds.query(context.Background(), pCtx, backend.DataQuery{RefID: "A", QueryType: "stream", JSON: model, TimeRange: tr})
+		if res.Error != nil || len(res.Frames) != 1 {
+			t.Fatalf("Error registering polled stream: %v", res.Error)
+		}
+		channels = append(channels, res.Frames[0].Meta.Channel)
+	}
+	if channels[0] != channels[1] || !strings.HasPrefix(channels[0], "ds/kdb1/poll/") {
+		t.Fatalf("Expected identical polled queries to share a channel, got %v", channels)
+	}
+	res := ds.query(context.Background(), pCtx, backend.DataQuery{RefID: "A", QueryType: "stream", JSON: []byte(`{"queryText":"x","stream":{"mode":"poll"}}`)})
+	if res.Error == nil {
+		t.Errorf("Expected polled stream without key or time column to be refused")
+	}
+	if atomic.LoadInt32(&polls) != 0 {
+		t.Errorf("Registering a polled stream should not run the query")
+	}
+
+	path := strings.TrimPrefix(channels[0], "ds/kdb1/")
+	sub, _ := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: path})
+	if sub.Status != backend.SubscribeStreamStatusOK {
+		t.Errorf("Expected subscription to registered poll stream to be allowed")
+	}
+	sub, _ = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: "poll/unknown"})
+	if sub.Status != backend.SubscribeStreamStatusNotFound {
+		t.Errorf("Expected subscription to unknown poll stream to be refused")
+	}
+	// the query runs with the details of the user who registered it, so other users get their own channel
+	other := pCtx
+	other.User = &backend.User{Login: "other"}
+	sub, _ = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: path, PluginContext: other})
+	if sub.Status != backend.SubscribeStreamStatusPermissionDenied {
+		t.Errorf("Expected another user's subscription to a registered poll stream to be refused")
+	}
+	res = ds.query(context.Background(), other, backend.DataQuery{RefID: "A", QueryType: "stream", JSON: model, TimeRange: tr})
+	if res.Error != nil || len(res.Frames) != 1 || res.Frames[0].Meta.Channel == channels[0] {
+		t.Errorf("Expected another user's identical polled query to have its own channel, got %v", res.Error)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sender := &mockPacketSender{packets: make(chan *backend.StreamPacket, 10)}
+	errChan := make(chan error)
+	go func() {
+		errChan <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: path}, backend.NewStreamSender(sender))
+	}()
+	for i, expected := range []string{"[1,2]", "[3]", "[4]"} {
+		select {
+		case p := <-sender.packets:
+			if !strings.Contains(string(p.Data), `"values":[`+expected) {
+				t.Errorf("Expected poll %v to push ids %v, got %s", i, expected, p.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No frame pushed for poll %v", i)
+		}
+	}
+	cancel()
+	if err := <-errChan; err != nil {
+		t.Errorf("Expected poll stream to end cleanly, got %v", err)
+	}
+}
+
+func TestBackfillStream(t *testing.T) {
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	conn := newMockStreamConn()
+	ds.OpenStreamConnection = func(string) (kdbConn, error) { return conn, nil }
+	midnight := time.Now().UTC().Truncate(24 * time.Hour)
+	subscribed := make(chan struct{})
+	var queries int32
+	ds.RunKdbQuerySync = func(context.Context, *kdb.K, time.Duration) (*kdb.K, error) {
+		hours := []time.Duration{time.Hour, 2 * time.Hour}
+		// the subscribers are backfilled as they subscribe, and the stream catches up once the subscription is made
+		if atomic.AddInt32(&queries, 1) > 2 {
+			<-subscribed
+			hours = append(hours, 3*time.Hour)
+		}
+		times := make([]time.Time, len(hours))
+		for i, h := range hours {
+			times[i] = midnight.Add(h)
+		}
+		return kdb.NewTable([]string{"time", "price"}, []*kdb.K{kdb.Atom(kdb.KP, times), kdb.FloatV(make([]float64, len(hours)))}), nil
+	}
+	ms := func(hours int) string {
+		return strconv.FormatInt(midnight.Add(time.Duration(hours)*time.Hour).UnixNano()/int64(time.Millisecond), 10)
+	}
+	pCtx := backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "kdb1"}}
+	res := ds.query(context.Background(), pCtx, backend.DataQuery{RefID: "A", QueryType: "stream",
+		JSON: []byte(`{"queryText":"select from trade","stream":{"table":"trade","backfill":true}}`), TimeRange: backend.TimeRange{From: midnight, To: midnight.Add(3 * time.Hour)}})
+	if res.Error != nil || len(res.Frames) != 1 || !strings.HasPrefix(res.Frames[0].Meta.Channel, "ds/kdb1/backfill/") {
+		t.Fatalf("Expected a frame with a backfill channel, got %v", res.Error)
+	}
+	path := strings.TrimPrefix(res.Frames[0].Meta.Channel, "ds/kdb1/")
+	// the backfill runs with the details of the user who registered the query, so is not sent to other users
+	other := pCtx
+	other.User = &backend.User{Login: "other"}
+	sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: path, PluginContext: other})
+	if err != nil || sub.Status != backend.SubscribeStreamStatusPermissionDenied || sub.InitialData != nil || atomic.LoadInt32(&queries) != 0 {
+		t.Errorf("Expected another user's subscription to a backfilled stream to be refused without backfilling, got %v", err)
+	}
+	// every subscriber of the channel is backfilled, not only the first
+	for i := 0; i < 2; i++ {
+		sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: path})
+		if err != nil || sub.Status != backend.SubscribeStreamStatusOK {
+			t.Fatalf("Expected subscription %v to registered backfill stream to be allowed, got %v", i, err)
+		}
+		if sub.InitialData == nil || !strings.Contains(string(sub.InitialData.Data()), `"values":[[`+ms(1)+","+ms(2)+`]`) {
+			t.Errorf("Expected subscriber %v to be backfilled with its initial data, got %v", i, sub.InitialData)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sender := &mockPacketSender{packets: make(chan *backend.StreamPacket, 10)}
+	errChan := make(chan error)
+	go func() {
+		errChan <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: path}, backend.NewStreamSender(sender))
+	}()
+	sent := (<-conn.writes).Data.([]*kdb.K)
+	if sent[1].Data.(string) != "trade" {
+		t.Errorf("Expected subscription to trade")
+	}
+	schema := kdb.NewTable([]string{"time", "price"}, []*kdb.K{kdb.Atom(kdb.KN, []time.Duration{}), kdb.FloatV([]float64{})})
+	conn.reads <- mockStreamMsg{kdb.NewList(kdb.Symbol("trade"), schema), kdb.RESPONSE}
+	update := func(spans ...time.Duration) {
+		prices := make([]float64, len(spans))
+		for i, span := range spans {
+			prices[i] = span.Hours()
+		}
+		conn.reads <- mockStreamMsg{kdb.NewList(kdb.Symbol("upd"), kdb.Symbol("trade"),
+			kdb.NewList(kdb.Atom(kdb.KN, spans), kdb.FloatV(prices))), kdb.ASYNC}
+	}
+	// published while the catch-up query runs, overlapping its result
+	update(2*time.Hour, 3*time.Hour)
+	close(subscribed)
+	update(4 * time.Hour)
+
+	// the stream pushes the rows missed between the subscribers' backfill and the subscription, then live updates
+	for i, expected := range [][]string{{ms(3)}, {ms(4)}} {
+		select {
+		case p := <-sender.packets:
+			if !strings.Contains(string(p.Data), `"values":[[`+strings.Join(expected, ",")+`]`) {
+				t.Errorf("Expected frame %v to have times %v, got %s", i, expected, p.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No frame pushed for %v", i)
+		}
+	}
+	cancel()
+	if err := <-errChan; err != nil {
+		t.Errorf("Expected backfill stream to end cleanly, got %v", err)
+	}
+}
+
+func TestStreamConflation(t *testing.T) {
+	s := &StreamQuery{Table: "quote", Syms: []string{"AAPL"}, StreamConflation: StreamConflation{Conflation: "ohlc", ConflationInterval: 60000, SizeColumn: "size"}}
+	if s.path() != "tick/quote/AAPL/conflation=ohlc/conflationInterval=60000/sizeColumn=size" {
+		t.Errorf("Unexpected conflated stream path %v", s.path())
+	}
+	parsed, err := parseTickPath(s.path())
+	if err != nil || parsed.path() != s.path() || strings.Join(parsed.Syms, ",") != "AAPL" {
+		t.Errorf("Expected conflation options to be read back from stream path, got %v", err)
+	}
+	if _, err = parseTickPath("tick/quote/conflation=fast"); err == nil {
+		t.Errorf("Expected unsupported conflation in stream path to be refused")
+	}
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	res := ds.query(context.Background(), backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "kdb1"}},
+		backend.DataQuery{RefID: "A", QueryType: "stream", JSON: []byte(`{"stream":{"table":"quote","conflation":"fast"}}`)})
+	if res.Error == nil {
+		t.Errorf("Expected unsupported conflation to be refused")
+	}
+
+	frame := func(tbl *kdb.K) *data.Frame {
+		f, err := ParseSimpleKdbTable(tbl)
+		if err != nil {
+			t.Fatalf("Error parsing test table: %v", err)
+		}
+		return f
+	}
+	pushed := func(sender *mockPacketSender) []string {
+		out := []string{}
+		for len(sender.packets) > 0 {
+			out = append(out, string((<-sender.packets).Data))
+		}
+		return out
+	}
+
+	// latest per sym, with updates merged across frames
+	sender := &mockPacketSender{packets: make(chan *backend.StreamPacket, 10)}
+	c := newStreamConflator(&StreamQuery{StreamConflation: StreamConflation{Conflation: "latest"}}, backend.NewStreamSender(sender))
+	c.SendFrame(frame(kdb.NewTable([]string{"sym", "price"}, []*kdb.K{kdb.SymbolV([]string{"A", "B"}), kdb.FloatV([]float64{1, 2})})), data.IncludeAll)
+	c.SendFrame(frame(kdb.NewTable([]string{"sym", "price"}, []*kdb.K{kdb.SymbolV([]string{"A"}), kdb.FloatV([]float64{3})})), data.IncludeAll)
+	c.flush()
+	c.flush()
+	frames := pushed(sender)
+	if len(frames) != 1 || !strings.Contains(frames[0], `"values":[["B","A"],[2,3]]`) {
+		t.Errorf("Expected one frame of the latest row of each sym, got %v", frames)
+	}
+
+	// OHLC bars, sent once a later row closes them, on the rows' timestamps rather than the server's clock
+	start := time.Date(2001, 1, 1, 9, 0, 0, 0, time.UTC)
+	ticks := kdb.NewTable([]string{"time", "price", "size"}, []*kdb.K{
+		kdb.Atom(kdb.KP, []time.Time{start, start.Add(30 * time.Second), start.Add(59 * time.Second), start.Add(61 * time.Second)}),
+		kdb.FloatV([]float64{1, 3, 2, 5}), kdb.LongV([]int64{10, 20, 30, 40})})
+	late := kdb.NewTable([]string{"time", "price", "size"}, []*kdb.K{kdb.Atom(kdb.KP, []time.Time{start.Add(10 * time.Second)}), kdb.FloatV([]float64{100}), kdb.LongV([]int64{1})})
+	c = newStreamConflator(s, backend.NewStreamSender(sender))
+	c.SendFrame(frame(ticks), data.IncludeAll)
+	c.SendFrame(frame(late), data.IncludeAll)
+	c.flush()
+	c.flush()
+	frames = pushed(sender)
+	ms := strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10)
+	if len(frames) != 1 || !strings.Contains(frames[0], `"values":[[`+ms+`],[1],[3],[1],[2],[60]]`) {
+		t.Errorf("Expected only the OHLC bar passed by a later row, ignoring late rows, got %v", frames)
+	}
+	c.SendFrame(frame(kdb.NewTable([]string{"time", "price", "size"}, []*kdb.K{kdb.Atom(kdb.KP, []time.Time{start.Add(2 * time.Minute)}), kdb.FloatV([]float64{7}), kdb.LongV([]int64{1})})), data.IncludeAll)
+	c.flush()
+	frames = pushed(sender)
+	if len(frames) != 1 || !strings.Contains(frames[0], "[5],[5],[5],[5],[40]]") {
+		t.Errorf("Expected the OHLC bar to close once a row of a later bar arrives, got %v", frames)
+	}
+	if strings.Contains(frames[0], "schema") {
+		t.Errorf("Expected the schema of OHLC bars to be sent once")
+	}
+	// a sym's bar is closed on the ticker once a row of any sym is past it
+	c = newStreamConflator(&StreamQuery{StreamConflation: StreamConflation{Conflation: "ohlc", ConflationInterval: 60000}}, backend.NewStreamSender(sender))
+	c.SendFrame(frame(kdb.NewTable([]string{"time", "sym", "price"}, []*kdb.K{
+		kdb.Atom(kdb.KP, []time.Time{start, start.Add(time.Minute)}), kdb.SymbolV([]string{"A", "B"}), kdb.FloatV([]float64{1, 2})})), data.IncludeAll)
+	c.flush()
+	if frames = pushed(sender); len(frames) != 1 || !strings.Contains(frames[0], `"values":[[`+ms+`],["A"]`) {
+		t.Errorf("Expected the bar of A to close on a later row of B, got %v", frames)
+	}
+	if err := c.SendFrame(frame(kdb.NewTable([]string{"time"}, []*kdb.K{kdb.Atom(kdb.KP, []time.Time{start})})), data.IncludeAll); err == nil {
+		t.Errorf("Expected OHLC bars of a stream without a price column to fail")
+	}
+
+	// a maximum rate merges frames between sends
+	c = newStreamConflator(&StreamQuery{StreamConflation: StreamConflation{MaxFPS: 10}}, backend.NewStreamSender(sender))
+	if c.period != 100*time.Millisecond {
+		t.Errorf("Expected 10 frames a second to send every 100ms, got %v", c.period)
+	}
+	c.SendFrame(frame(kdb.NewTable([]string{"sym"}, []*kdb.K{kdb.SymbolV([]string{"A"})})), data.IncludeAll)
+	c.SendFrame(frame(kdb.NewTable([]string{"sym"}, []*kdb.K{kdb.SymbolV([]string{"A"})})), data.IncludeAll)
+	c.flush()
+	if frames = pushed(sender); len(frames) != 1 || !strings.Contains(frames[0], `"values":[["A","A"]]`) {
+		t.Errorf("Expected frames to be merged, got %v", frames)
+	}
+	if _, err = parseTickPath("tick/quote/maxFps=2000000000"); err == nil {
+		t.Errorf("Expected a maximum rate above %v frames a second to be refused", maxStreamFPS)
+	}
+	if newStreamConflator(&StreamQuery{}, backend.NewStreamSender(sender)) != nil {
+		t.Errorf("Expected no conflator without conflation options")
+	}
+}
+
+func TestCheckHealthSuccess(t *testing.T) {
+	// Init
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	ds.RunKdbQuerySync = func(context.Context, *kdb.K, time.Duration) (*kdb.K, error) { return kdb.Long(2), nil }
+	res, err := ds.CheckHealth(nil, nil)
+	if err != nil {
+		t.Errorf("Error running CheckHealth: %v", err)
+		return
+	}
+	if res.Status != backend.HealthStatusOk {
+		t.Errorf("Successful CheckHealth did not return OK health status")
+		return
+	}
+}
+
+func TestCheckHealthFailValue(t *testing.T) {
+	// Init
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	ds.RunKdbQuerySync = func(context.Context, *kdb.K, time.Duration) (*kdb.K, error) { return kdb.Long(3), nil }
+	res, err := ds.CheckHealth(nil, nil)
+	if err != nil {
+		t.Errorf("Error running CheckHealth: %v", err)
+		return
+	}
+	if res.Status != backend.HealthStatusError {
+		t.Errorf("Erroring CheckHealth did not return Error health status")
+		return
+	}
+}
+
+func TestCheckHealthFailType(t *testing.T) {
+	// Init
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	ds.RunKdbQuerySync = func(context.Context, *kdb.K, time.Duration) (*kdb.K, error) {
+		return kdb.Error(fmt.Errorf("kdb+ server-side error")), nil
+	}
+	res, err := ds.CheckHealth(nil, nil)
+	if err != nil {
+		t.Errorf("Error running CheckHealth: %v", err)
+		return
+	}
+	if res.Status != backend.HealthStatusError {
+		t.Errorf("Erroring CheckHealth did not return Error health status")
+		return
+	}
+}
+
+func TestCheckHealthFailError(t *testing.T) {
+	// Init
+	ds := &KdbDatasource{}
+	ds.setupKdbConnectionHandlers()
+	ds.RunKdbQuerySync = func(context.Context, *kdb.K, time.Duration) (*kdb.K, error) {
 		return nil, fmt.Errorf("Go backend-side error")
 	}
 	res, err := ds.CheckHealth(nil, nil)
@@ -1,51 +1,164 @@
-import { DataSourceInstanceSettings } from '@grafana/data';
-import { DataSourceWithBackend, getBackendSrv, getTemplateSrv, toDataQueryResponse } from '@grafana/runtime';
-import {MyDataSourceOptions, MyQuery, MyVariableQuery} from './types';
+import {
+  DataQueryRequest,
+  DataQueryResponse,
+  DataSourceInstanceSettings,
+  MetricFindValue,
+  ScopedVars,
+} from '@grafana/data';
+import { DataSourceWithBackend, getTemplateSrv } from '@grafana/runtime';
+import { from, Observable } from 'rxjs';
+import { mergeMap } from 'rxjs/operators';
+import {
+  AdhocFilter,
+  MyDataSourceOptions,
+  MyQuery,
+  MyVariableQuery,
+  ParseResult,
+  QueryArgument,
+  QueryVariable,
+  VariableType,
+} from './types';
 
+// macros expanded by the backend, which must be hidden from Grafana's interpolation of its own $__from etc.
+const backendMacros = /\$(__(?:timeFilter|timeBucket|from|to|interval_ms|interval)\b)/g;
+const maskedMacro = /\u0000(__\w+)/g;
+
+function interpolateQueryText(text: string, scopedVars?: ScopedVars): string {
+  return getTemplateSrv().replace(text.replace(backendMacros, '\u0000$1'), scopedVars).replace(maskedMacro, '$$$1');
+}
+
+// interpolates a typed value with the panel's scoped variables, multi-value variables in a single value as a csv
+function interpolateArgument(arg: QueryArgument, scopedVars: ScopedVars): QueryArgument {
+  const templateSrv = getTemplateSrv();
+  return {
+    ...arg,
+    value: arg.value ? templateSrv.replace(arg.value, scopedVars, 'csv') : arg.value,
+    values: arg.values ? arg.values.map((v) => templateSrv.replace(v, scopedVars)) : arg.values,
+  };
+}
 
 export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptions> {
+  adhocFilterTable?: string;
+  // column types from the last tag keys lookup, used to cast ad-hoc filter values
+  tagTypes: Record<string, VariableType> = {};
+  tagTypesLoaded?: Promise<void>;
+
   constructor(instanceSettings: DataSourceInstanceSettings<MyDataSourceOptions>) {
     super(instanceSettings);
+    this.adhocFilterTable = instanceSettings.jsonData.adhocFilterTable;
+    // annotation queries are edited like panel queries and marked so the backend returns annotation frames
+    this.annotations = {
+      prepareQuery: (anno: any) => (anno.target ? { ...anno.target, queryType: 'annotation' } : undefined),
+    };
+  }
+
+  async getTagKeys() {
+    if (!this.adhocFilterTable) {
+      return [];
+    }
+    const keys: Array<{ text: string; type: VariableType }> = await this.getResource('tag-keys', { table: this.adhocFilterTable });
+    keys.forEach((key) => (this.tagTypes[key.text] = key.type));
+    return keys;
+  }
+
+  // looks up the ad-hoc filter table's column types once, as filters restored from a dashboard or URL are applied
+  // without their keys having been listed
+  loadTagTypes(): Promise<void> {
+    if (!this.tagTypesLoaded) {
+      this.tagTypesLoaded = this.getTagKeys().then(
+        () => undefined,
+        () => {
+          // retried by the next query; until then values are sent as strings
+          this.tagTypesLoaded = undefined;
+        }
+      );
+    }
+    return this.tagTypesLoaded;
+  }
+
+  query(request: DataQueryRequest<MyQuery>): Observable<DataQueryResponse> {
+    if (!this.adhocFilterTable || !(getTemplateSrv() as any).getAdhocFilters(this.name).length) {
+      return super.query(request);
+    }
+    return from(this.loadTagTypes()).pipe(mergeMap(() => super.query(request)));
+  }
+
+  async getTagValues(options: any) {
+    if (!this.adhocFilterTable) {
+      return [];
+    }
+    return this.getResource('tag-values', { table: this.adhocFilterTable, key: options.key });
   }
-  applyTemplateVariables(query: MyQuery) {
+  applyTemplateVariables(query: MyQuery, scopedVars: ScopedVars) {
     const templateSrv = getTemplateSrv();
+    // forward each variable's current value(s) so kdb+ receives them already cast rather than interpolated
+    const variables: Record<string, QueryVariable> = {};
+    for (const variable of templateSrv.getVariables()) {
+      let values: string[] = [];
+      let multi = false;
+      templateSrv.replace('$' + variable.name, scopedVars, (value: string | string[]) => {
+        multi = Array.isArray(value);
+        values = multi ? (value as string[]) : [value as string];
+        return '';
+      });
+      variables[variable.name] = { values, multi, type: query.variableTypes?.[variable.name] };
+    }
+    const adhocFilters: AdhocFilter[] = (templateSrv as any).getAdhocFilters(this.name).map((filter: AdhocFilter) => ({
+      key: filter.key,
+      operator: filter.operator,
+      value: filter.value,
+      type: this.tagTypes[filter.key],
+    }));
     return {
       ...query,
-      queryText: query.queryText ? templateSrv.replace(query.queryText) : '',
+      variables,
+      adhocFilters,
+      queryText: query.queryText ? interpolateQueryText(query.queryText, scopedVars) : '',
+      function: query.function ? templateSrv.replace(query.function, scopedVars) : '',
+      arguments: (query.arguments || []).map((arg) => interpolateArgument(arg, scopedVars)),
+      builder: query.builder
+        ? {
+            ...query.builder,
+            where: (query.builder.where || []).map((filter) => ({
+              ...filter,
+              value: filter.value ? interpolateArgument(filter.value, scopedVars) : filter.value,
+            })),
+          }
+        : query.builder,
     };
 
   }
 
-  async metricFindQuery(query: MyVariableQuery, options?: any): Promise<any> {
+  async metricFindQuery(query: MyVariableQuery, options?: any): Promise<MetricFindValue[]> {
     const templateSrv = getTemplateSrv();
-    let timeout = parseInt(query.timeOut, 10)
-    const body: any = {
-      queries: [
-        { datasourceId:this.id,
-          orgId: this.id,
-          queryText: query.queryText ? templateSrv.replace(query.queryText) : '',
-          timeOut: timeout,
-        }
-      ]
+    // errors are thrown so that Grafana reports them on the variable rather than offering them as an option
+    return this.postResource('variable-query', {
+      queryText: query.queryText ? interpolateQueryText(query.queryText) : '',
+      timeOut: parseInt(query.timeOut, 10),
+      from: options?.range ? options.range.from.valueOf() : templateSrv.timeRange().from.valueOf(),
+      to: options?.range ? options.range.to.valueOf() : templateSrv.timeRange().to.valueOf(),
+    });
+  }
+
+  // the log volume histogram in Explore, counted per level and interval by the backend
+  getLogsVolumeDataProvider(request: DataQueryRequest<MyQuery>): Observable<DataQueryResponse> | undefined {
+    const targets = request.targets.filter((target) => target.queryType === 'logs' && !target.hide);
+    if (!targets.length) {
+      return undefined;
     }
+    return this.query({
+      ...request,
+      targets: targets.map((target) => ({ ...target, refId: `log-volume-${target.refId}`, queryType: 'logVolume' })),
+    });
+  }
 
-    const backendQuery = getBackendSrv()
-      .datasourceRequest({
-          url: '/api/ds/query',
-          method: 'POST',
-          data: body,
-        }).then((response: any) => {
-          let parsedResponse = toDataQueryResponse(response)
-          let responseValues: any[] = []
-          for (let frame in parsedResponse.data) {
-            responseValues = responseValues.concat(parsedResponse.data[frame].fields[0].values.toArray().map((x: any) => { return {text: x} }))
-            }
-          return responseValues
-        }).catch(err => {
-          console.log(err)
-          err.isHandled = true; // Avoid extra popup warning
-          return ({ text:"ERROR"})
-        });
-    return backendQuery
+  // checks query syntax with kdb+'s parse without running the query, for linting in the editor
+  async parseQuery(queryText: string): Promise<ParseResult> {
+    const range = getTemplateSrv().timeRange();
+    return this.postResource('parse', {
+      queryText: interpolateQueryText(queryText),
+      from: range.from.valueOf(),
+      to: range.to.valueOf(),
+    });
   }
 }
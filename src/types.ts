@@ -6,6 +6,124 @@ export interface MyQuery extends DataQuery {
   useTimeColumn: boolean;
   timeColumn: string;
   includeKeyColumns: boolean;
+  queryMode?: 'text' | 'function' | 'builder';
+  function?: string;
+  arguments?: QueryArgument[];
+  variableTypes?: Record<string, VariableType>;
+  variables?: Record<string, QueryVariable>;
+  builder?: BuilderQuery;
+  adhocFilters?: AdhocFilter[];
+  queryType?: 'annotation' | 'logs' | 'logVolume' | 'stream';
+  logs?: LogsQuery;
+  stream?: StreamQuery;
+}
+
+/**
+ * Streams to the panel over Grafana Live, either a tickerplant table filtered
+ * to the given syms if any, or the panel's query polled every interval (ms),
+ * pushing only rows with a new key or a later time. A backfilled tickerplant
+ * stream first pushes the panel's query, then only updates with a later
+ * sequence number or time. Any stream may be conflated to the latest row of
+ * each sym or to OHLC bars every conflationInterval (ms), and limited to
+ * maxFps frames a second.
+ */
+export interface StreamQuery {
+  mode?: 'tick' | 'poll';
+  table?: string;
+  syms?: string[];
+  interval?: number;
+  keyColumn?: string;
+  timeColumn?: string;
+  backfill?: boolean;
+  sequenceColumn?: string;
+  conflation?: 'latest' | 'ohlc';
+  conflationInterval?: number;
+  maxFps?: number;
+  symColumn?: string;
+  priceColumn?: string;
+  sizeColumn?: string;
+}
+
+/**
+ * The columns of a logs query's table holding each line's message, level
+ * and labels.
+ */
+export interface LogsQuery {
+  messageColumn?: string;
+  levelColumn?: string;
+  labelColumns?: string[];
+}
+
+/**
+ * An ad-hoc filter, forwarded to kdb+ in the Filters table with its value
+ * cast to the type of the filtered column.
+ */
+export interface AdhocFilter {
+  key: string;
+  operator: string;
+  value: string;
+  type?: VariableType;
+}
+
+/**
+ * A query from the visual query builder, compiled by the backend to a
+ * functional select.
+ */
+export interface BuilderQuery {
+  table: string;
+  columns?: BuilderColumn[];
+  where?: BuilderFilter[];
+  by?: string[];
+  timeColumn?: string;
+  timeBucket?: boolean;
+}
+
+export interface BuilderColumn {
+  name: string;
+  aggregation?: 'avg' | 'sum' | 'min' | 'max' | 'first' | 'last' | 'count' | 'dev' | 'med';
+  alias?: string;
+}
+
+export interface BuilderFilter {
+  column: string;
+  operator: '=' | '<>' | '<' | '>' | '<=' | '>=' | 'in' | 'within' | 'like';
+  value: QueryArgument;
+}
+
+export type VariableType = 'boolean' | 'int' | 'long' | 'float' | 'symbol' | 'string' | 'timestamp';
+
+/**
+ * The current value of a template variable, forwarded to kdb+ in the
+ * Variables dictionary cast to its type (a string by default).
+ */
+export interface QueryVariable {
+  values: string[];
+  multi: boolean;
+  type?: VariableType;
+}
+
+/**
+ * A typed argument to a function query. List types take their items from
+ * values, or else from value split on commas.
+ */
+export interface QueryArgument {
+  type:
+    | 'boolean'
+    | 'int'
+    | 'long'
+    | 'float'
+    | 'symbol'
+    | 'string'
+    | 'timestamp'
+    | 'booleanList'
+    | 'intList'
+    | 'longList'
+    | 'floatList'
+    | 'symbolList'
+    | 'stringList'
+    | 'timestampList';
+  value?: string;
+  values?: string[];
 }
 
 /**
@@ -18,6 +136,52 @@ export interface MyDataSourceOptions extends DataSourceJsonData {
   withTLS: boolean;
   skipVerifyTLS: boolean;
   withCACert: boolean;
+  connectionMode?: 'tcp' | 'unix';
+  socketPath?: string;
+  poolMinSize?: number;
+  poolMaxSize?: number;
+  poolIdleTimeout?: string;
+  maxConcurrentQueries?: number;
+  asyncQueries?: boolean;
+  endpoints?: KdbEndpoint[];
+  failbackInterval?: string;
+  loadBalancing?: 'failover' | 'roundRobin' | 'leastOutstanding' | 'random';
+  reconnectBackoffMin?: string;
+  reconnectBackoffMax?: string;
+  breakerThreshold?: number;
+  heartbeatInterval?: string;
+  tcpKeepAlive?: string;
+  userPassthrough?: boolean;
+  credentialScheme?: 'sharedPassword' | 'loginOnly';
+  entryFunction?: string;
+  healthCheckFunction?: string;
+  adhocFilterTable?: string;
+  schemaCacheTTL?: string;
+  parseTimeout?: string;
+  validateQueries?: boolean;
+  tickerplantHost?: string;
+  tickerplantPort?: number;
+}
+
+/**
+ * The result of checking query syntax; position is the offset of the likely cause of a parse error.
+ */
+export interface ParseResult {
+  valid: boolean;
+  error?: string;
+  position?: number;
+  line?: number;
+  column?: number;
+}
+
+/**
+ * A kdb+ process in the ordered endpoint list; the first is the primary.
+ * If no endpoints are configured the host and port are used instead.
+ */
+export interface KdbEndpoint {
+  host: string;
+  port: number;
+  socketPath?: string;
 }
 
 export const defaultConfig: Partial<MyDataSourceOptions> = {